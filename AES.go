@@ -1,6 +1,23 @@
 package main
 
-import "bytes"
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	NonceSize = 12
+	TagSize   = 16
+	// AEADOverhead is what encryptBits adds on top of the plaintext
+	AEADOverhead = NonceSize + TagSize
+)
+
+// ErrTampered is returned when an authentication tag does not match.
+var ErrTampered = errors.New("image was tampered with")
 
 // S-Box: The standard AES substitution table
 var sbox = [256]byte{
@@ -26,13 +43,24 @@ var rcon = [11]byte{
 	0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x20, 0x40, 0x80, 0x1b, 0x36,
 }
 
-func pkcs7Pad(data []byte, blockSize int) []byte {
-	padding := blockSize - (len(data) % blockSize)
-	padText := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(data, padText...)
+// validKeySize reports whether n is an AES-128, AES-192 or AES-256 key length.
+func validKeySize(n int) bool {
+	return n == 16 || n == 24 || n == 32
 }
 
 func aesEncryptBlock(chunk []byte, key []byte) ([]byte, error) {
+	roundKeys, err := keyExpansion(key)
+	if err != nil {
+		return nil, err
+	}
+	return encryptBlockExpanded(chunk, roundKeys), nil
+}
+
+// encryptBlockExpanded runs one block through AES with an already expanded
+// key. The round count follows from the schedule: 10, 12 or 14.
+func encryptBlockExpanded(chunk []byte, roundKeys [][]byte) []byte {
+	rounds := len(roundKeys) - 1
+
 	stateMatrix := make([][]byte, 4)
 	for i := range 4 {
 		stateMatrix[i] = make([]byte, 4)
@@ -42,11 +70,10 @@ func aesEncryptBlock(chunk []byte, key []byte) ([]byte, error) {
 			stateMatrix[j][i] = chunk[i*4+j]
 		}
 	}
-	roundKeys := keyExpansion(key)
 	// Initial AddRoundKey
 	addRoundKey(stateMatrix, roundKeys[0])
-	// 9 Main Rounds
-	for round := 1; round <= 9; round++ {
+	// Main Rounds
+	for round := 1; round < rounds; round++ {
 		subBytes(stateMatrix)
 		shiftRows(stateMatrix)
 		mixColumns(stateMatrix)
@@ -55,7 +82,7 @@ func aesEncryptBlock(chunk []byte, key []byte) ([]byte, error) {
 	// Final Round
 	subBytes(stateMatrix)
 	shiftRows(stateMatrix)
-	addRoundKey(stateMatrix, roundKeys[10])
+	addRoundKey(stateMatrix, roundKeys[rounds])
 	encryptedBlock := make([]byte, 16)
 
 	for i := range 4 {
@@ -64,7 +91,7 @@ func aesEncryptBlock(chunk []byte, key []byte) ([]byte, error) {
 		}
 	}
 
-	return encryptedBlock, nil
+	return encryptedBlock
 }
 
 func addRoundKey(state [][]byte, roundKey []byte) {
@@ -115,51 +142,108 @@ func mixColumns(state [][]byte) {
 	}
 }
 
-func keyExpansion(key []byte) [][]byte {
-	w := make([]byte, 176)
-	copy(w[:16], key)
+// keyExpansion builds the round keys for a 16, 24 or 32-byte key
+// (Nk = 4, 6 or 8 words, Nr = Nk + 6 rounds).
+func keyExpansion(key []byte) ([][]byte, error) {
+	if !validKeySize(len(key)) {
+		return nil, fmt.Errorf("invalid AES key size %d", len(key))
+	}
+
+	nk := len(key) / 4
+	rounds := nk + 6
+	totalWords := 4 * (rounds + 1)
+
+	w := make([]byte, totalWords*4)
+	copy(w[:len(key)], key)
 
-	for i := 4; i < 44; i++ {
+	for i := nk; i < totalWords; i++ {
 		temp := make([]byte, 4)
 		copy(temp, w[(i-1)*4:(i-1)*4+4])
 
-		if i%4 == 0 {
+		if i%nk == 0 {
 			temp[0], temp[1], temp[2], temp[3] = temp[1], temp[2], temp[3], temp[0]
 
 			for j := range 4 {
 				temp[j] = sbox[temp[j]]
 			}
 
-			temp[0] ^= rcon[i/4]
+			temp[0] ^= rcon[i/nk]
+		} else if nk > 6 && i%nk == 4 {
+			// AES-256 only: extra SubWord halfway through each key
+			for j := range 4 {
+				temp[j] = sbox[temp[j]]
+			}
 		}
 
 		for j := range 4 {
-			w[i*4+j] = w[(i-4)*4+j] ^ temp[j]
+			w[i*4+j] = w[(i-nk)*4+j] ^ temp[j]
 		}
 	}
 
-	roundKeys := make([][]byte, 11)
-	for r := range 11 {
+	roundKeys := make([][]byte, rounds+1)
+	for r := range rounds + 1 {
 		roundKeys[r] = w[r*16 : (r+1)*16]
 	}
-	return roundKeys
+	return roundKeys, nil
 }
 
-func encryptBits(data []byte, password []byte) ([]byte, error) {
+// aesCTR XORs data with the AES keystream for nonce || counter, counting from 1.
+// Encryption and decryption are the same operation.
+func aesCTR(data []byte, key []byte, nonce []byte) ([]byte, error) {
 	const blockSize = 16
 
-	padded := pkcs7Pad(data, blockSize)
+	roundKeys, err := keyExpansion(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(data))
+	counterBlock := make([]byte, blockSize)
+	copy(counterBlock, nonce)
 
-	encrypted := make([]byte, 0, len(padded))
+	var counter uint32 = 1
+	for offset := 0; offset < len(data); offset += blockSize {
+		binary.BigEndian.PutUint32(counterBlock[NonceSize:], counter)
+		keystream := encryptBlockExpanded(counterBlock, roundKeys)
 
-	for offset := 0; offset < len(padded); offset += blockSize {
-		block := padded[offset : offset+blockSize]
-		encBlock, err := aesEncryptBlock(block, password)
-		if err != nil {
-			return nil, err
+		end := min(offset+blockSize, len(data))
+		for i := offset; i < end; i++ {
+			out[i] = data[i] ^ keystream[i-offset]
 		}
-		encrypted = append(encrypted, encBlock...)
+		counter++
+	}
+	return out, nil
+}
+
+// computeTag is HMAC-SHA256 over len(aad) || aad || nonce || ciphertext,
+// truncated to TagSize.
+func computeTag(macKey, aad, nonce, ciphertext []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	var aadLen [8]byte
+	binary.BigEndian.PutUint64(aadLen[:], uint64(len(aad)))
+	mac.Write(aadLen[:])
+	mac.Write(aad)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
+	return mac.Sum(nil)[:TagSize]
+}
+
+// encryptBits seals data with AES-CTR and an HMAC-SHA256 tag (encrypt-then-MAC).
+// The result is nonce || ciphertext || tag; aad is authenticated but not stored.
+func encryptBits(data []byte, key []byte, macKey []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := aesCTR(data, key, nonce)
+	if err != nil {
+		return nil, err
 	}
 
-	return encrypted, nil
+	sealed := make([]byte, 0, len(data)+AEADOverhead)
+	sealed = append(sealed, nonce...)
+	sealed = append(sealed, ciphertext...)
+	sealed = append(sealed, computeTag(macKey, aad, nonce, ciphertext)...)
+	return sealed, nil
 }
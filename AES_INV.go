@@ -1,7 +1,7 @@
 package main
 
 import (
-	"errors"
+	"crypto/hmac"
 	"fmt"
 )
 
@@ -25,6 +25,12 @@ var rsbox = [256]byte{
 }
 
 func aesDecryptBlock(chunk []byte, key []byte) ([]byte, error) {
+	roundKeys, err := keyExpansion(key)
+	if err != nil {
+		return nil, err
+	}
+	rounds := len(roundKeys) - 1
+
 	stateMatrix := make([][]byte, 4)
 	for i := 0; i < 4; i++ {
 		stateMatrix[i] = make([]byte, 4)
@@ -35,13 +41,11 @@ func aesDecryptBlock(chunk []byte, key []byte) ([]byte, error) {
 		}
 	}
 
-	roundKeys := keyExpansion(key)
-
-	addRoundKey(stateMatrix, roundKeys[10])
+	addRoundKey(stateMatrix, roundKeys[rounds])
 	invShiftRows(stateMatrix)
 	invSubBytes(stateMatrix)
 
-	for round := 9; round >= 1; round-- {
+	for round := rounds - 1; round >= 1; round-- {
 		addRoundKey(stateMatrix, roundKeys[round])
 		invMixColumns(stateMatrix)
 		invShiftRows(stateMatrix)
@@ -100,48 +104,20 @@ func invMixColumns(state [][]byte) {
 	}
 }
 
-func pkcs7Unpad(data []byte) ([]byte, error) {
-	length := len(data)
-	if length == 0 {
-		return nil, errors.New("data is empty")
-	}
-	padding := int(data[length-1])
-
-	if padding > length || padding == 0 {
-		return nil, errors.New("invalid padding size")
-	}
-
-	for i := 0; i < padding; i++ {
-		if data[length-1-i] != byte(padding) {
-			return nil, errors.New("invalid padding bytes")
-		}
-	}
-
-	return data[:length-padding], nil
-}
-
-func decryptBits(encryptedData []byte, password []byte) ([]byte, error) {
-	const blockSize = 16
-
-	if len(encryptedData)%blockSize != 0 {
-		return nil, fmt.Errorf("ciphertext length is not a multiple of block size")
+// decryptBits checks the tag of a blob made by encryptBits and only then
+// decrypts it. A bad tag gives ErrTampered and no plaintext.
+func decryptBits(sealed []byte, key []byte, macKey []byte, aad []byte) ([]byte, error) {
+	if len(sealed) < AEADOverhead {
+		return nil, fmt.Errorf("ciphertext too short")
 	}
 
-	decrypted := make([]byte, 0, len(encryptedData))
+	nonce := sealed[:NonceSize]
+	ciphertext := sealed[NonceSize : len(sealed)-TagSize]
+	tag := sealed[len(sealed)-TagSize:]
 
-	for offset := 0; offset < len(encryptedData); offset += blockSize {
-		block := encryptedData[offset : offset+blockSize]
-		decBlock, err := aesDecryptBlock(block, password)
-		if err != nil {
-			return nil, err
-		}
-		decrypted = append(decrypted, decBlock...)
-	}
-
-	unpadded, err := pkcs7Unpad(decrypted)
-	if err != nil {
-		return nil, fmt.Errorf("unpadding failed: %v", err)
+	if !hmac.Equal(tag, computeTag(macKey, aad, nonce, ciphertext)) {
+		return nil, ErrTampered
 	}
 
-	return unpadded, nil
+	return aesCTR(ciphertext, key, nonce)
 }
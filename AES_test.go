@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSealedRoundTrip(t *testing.T) {
+	key, macKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	aad := []byte("prefix")
+	data := []byte("attack at dawn, or maybe a little later")
+
+	sealed, err := encryptBits(data, key, macKey, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != len(data)+AEADOverhead {
+		t.Fatalf("sealed %d bytes, want %d", len(sealed), len(data)+AEADOverhead)
+	}
+	opened, err := decryptBits(sealed, key, macKey, aad)
+	if err != nil || !bytes.Equal(opened, data) {
+		t.Fatalf("decryptBits = %q, %v", opened, err)
+	}
+
+	// Same data, fresh nonce
+	again, err := encryptBits(data, key, macKey, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, sealed) {
+		t.Error("two seals of the same data are equal")
+	}
+
+	sealed[NonceSize] ^= 1
+	if _, err := decryptBits(sealed, key, macKey, aad); err != ErrTampered {
+		t.Errorf("flipped ciphertext bit: err = %v, want ErrTampered", err)
+	}
+	sealed[NonceSize] ^= 1
+	if _, err := decryptBits(sealed, key, macKey, []byte("other")); err != ErrTampered {
+		t.Errorf("other aad: err = %v, want ErrTampered", err)
+	}
+	if _, err := decryptBits(sealed[:AEADOverhead-1], key, macKey, aad); err == nil {
+		t.Error("short ciphertext accepted")
+	}
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// FIPS-197 appendix C: one block under each key size.
+func TestAESKnownAnswers(t *testing.T) {
+	plaintext := "00112233445566778899aabbccddeeff"
+	tests := []struct {
+		name, key, ciphertext string
+	}{
+		{"C.1 AES-128", "000102030405060708090a0b0c0d0e0f", "69c4e0d86a7b0430d8cdb78070b4c55a"},
+		{"C.2 AES-192", "000102030405060708090a0b0c0d0e0f1011121314151617", "dda97ca4864cdfe06eaf70a0ec0d7191"},
+		{"C.3 AES-256", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", "8ea2b7ca516745bfeafc49904b496089"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, pt, ct := unhex(t, tt.key), unhex(t, plaintext), unhex(t, tt.ciphertext)
+
+			got, err := aesEncryptBlock(pt, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, ct) {
+				t.Errorf("encrypt = %x, want %x", got, ct)
+			}
+
+			got, err = aesDecryptBlock(ct, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, pt) {
+				t.Errorf("decrypt = %x, want %x", got, pt)
+			}
+		})
+	}
+
+	if _, err := aesEncryptBlock(unhex(t, plaintext), make([]byte, 20)); err == nil {
+		t.Error("20-byte key accepted")
+	}
+}
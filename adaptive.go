@@ -0,0 +1,127 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+	"slices"
+)
+
+// Content-adaptive pixel selection. Noise in the low bits shows up on flat
+// areas (sky, backgrounds) and hides in texture, so the body prefers pixels
+// whose neighbourhood is busy.
+//
+// The cost map only looks at the bits from costShift up. Embedding never
+// goes deeper than MaxEmbedDepth bits, and matching in adaptive mode never
+// carries into these bits, so reveal rebuilds exactly the same map from the
+// stego image.
+const costShift = MaxEmbedDepth
+
+// textureMap scores every pixel by the summed absolute difference between
+// its coarse luminance and that of its eight neighbours. Header pixels are
+// left out as neighbours, since slots aren't written with that guarantee.
+// For 16-bit samples, where the whole edited byte is noise, the high byte
+// stands in for the coarse value.
+func textureMap(img *EditableImage) []int {
+	w, h := img.Width(), img.Height()
+
+	coarse := make([]int, w*h)
+	var high *image.NRGBA
+	if wide, ok := img.format.(wideFormat); ok {
+		high = wide.highBytes()
+	}
+	if high != nil {
+		for idx := range coarse {
+			p := high.Pix[high.PixOffset(idx%w, idx/w):]
+			coarse[idx] = int(p[0]) + int(p[1]) + int(p[2])
+		}
+	} else {
+		for idx := range coarse {
+			p := img.GetPixel(idx%w, idx/w)
+			coarse[idx] = int(p.R>>costShift) + int(p.G>>costShift) + int(p.B>>costShift)
+		}
+	}
+
+	texture := make([]int, w*h)
+	for idx := SplitPoint; idx < w*h; idx++ {
+		x, y := idx%w, idx/w
+		sum := 0
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				nx, ny := x+dx, y+dy
+				if nx < 0 || ny < 0 || nx >= w || ny >= h {
+					continue
+				}
+				if n := ny*w + nx; n >= SplitPoint {
+					sum += abs(coarse[n] - coarse[idx])
+				}
+			}
+		}
+		texture[idx] = sum
+	}
+	return texture
+}
+
+// wideFormat is a pixelFormat with more than 8 bits per sample, of which the
+// image holds only the low byte.
+type wideFormat interface {
+	highBytes() *image.NRGBA
+}
+
+// weight grows with the square of the texture score, so flat pixels are only
+// used once the busy ones run out.
+func weight(texture int) int {
+	return (1 + texture) * (1 + texture)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// GenerateAdaptivePoints is GeneratePointsInRange weighted by texture. Every
+// pixel draws a keyed random priority divided by its weight, and the lowest
+// priorities come first. Busy pixels are strongly favoured, but
+// the order still depends on the key, not just on the (public) image.
+func GenerateAdaptivePoints(img *EditableImage, seed []byte, count int, startIdx, endIdx int) ([]image.Point, error) {
+	windowSize := endIdx - startIdx
+
+	if windowSize <= 0 {
+		return nil, fmt.Errorf("invalid window range")
+	}
+	if count > windowSize {
+		return nil, fmt.Errorf("not enough pixels in window for requested count")
+	}
+
+	type candidate struct {
+		priority uint64
+		index    int
+	}
+
+	texture := textureMap(img)
+	stream := newKeyStream(seed)
+
+	candidates := make([]candidate, windowSize)
+	for i := range candidates {
+		index := startIdx + i
+		candidates[i] = candidate{
+			priority: (stream.Uint64() >> 32) / uint64(weight(texture[index])),
+			index:    index,
+		}
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		if c := cmp.Compare(a.priority, b.priority); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.index, b.index)
+	})
+
+	width := img.Width()
+	points := make([]image.Point, 0, count)
+	for _, c := range candidates[:count] {
+		points = append(points, image.Point{X: c.index % width, Y: c.index / width})
+	}
+	return points, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"image"
+	"slices"
+	"testing"
+)
+
+// halfNoisy is flat grey on the left and noise on the right, below the
+// header rows.
+func halfNoisy(w, h int) *EditableImage {
+	img := noisyRGBA(w, h, 11)
+	for idx := 0; idx < w*h; idx++ {
+		if idx%w < w/2 {
+			copy(img.Pix[idx*4:], []byte{0x80, 0x80, 0x80})
+		}
+	}
+	return &EditableImage{Img: img}
+}
+
+func TestTextureMapSurvivesEmbedding(t *testing.T) {
+	img := halfNoisy(120, 100)
+	before := textureMap(img)
+
+	for _, matching := range []bool{false, true} {
+		mode, _ := NewEmbeddingMode(MaxEmbedDepth, false)
+		mode.Adaptive, mode.Matching = true, matching
+		bits := make([]int, 3000)
+		rng := newKeyStream([]byte("bits"))
+		for i := range bits {
+			bits[i] = rng.Intn(2)
+		}
+		seed := []byte("body seed")
+		if _, err := img.EmbedBody(seed, bits, mode, newKeyStream([]byte("matching"))); err != nil {
+			t.Fatal(err)
+		}
+
+		if after := textureMap(img); !slices.Equal(before, after) {
+			t.Fatalf("matching %v: embedding changed the texture map", matching)
+		}
+		got, err := img.ExtractBody(seed, len(bits), mode)
+		if err != nil || !slices.Equal(got, bits) {
+			t.Fatalf("matching %v: extracted a different body, %v", matching, err)
+		}
+	}
+}
+
+func TestAdaptivePoints(t *testing.T) {
+	img := halfNoisy(120, 100)
+	start, end := SplitPoint, 120*100
+	count := (end - start) / 10
+
+	points, err := GenerateAdaptivePoints(img, []byte("seed"), count, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := GenerateAdaptivePoints(img, []byte("seed"), count, start, end)
+	if !slices.Equal(points, again) {
+		t.Error("same seed gave a different order")
+	}
+	other, _ := GenerateAdaptivePoints(img, []byte("other seed"), count, start, end)
+	if slices.Equal(points, other) {
+		t.Error("order doesn't depend on the seed")
+	}
+
+	seen := make(map[image.Point]bool)
+	busy := 0
+	for _, pt := range points {
+		if idx := pt.Y*120 + pt.X; idx < start || idx >= end || seen[pt] {
+			t.Fatalf("point %v repeated or out of range", pt)
+		}
+		seen[pt] = true
+		if pt.X > 120/2 {
+			busy++
+		}
+	}
+	if busy < count*9/10 {
+		t.Errorf("%d of %d points in the busy half", busy, count)
+	}
+
+	if _, err := GenerateAdaptivePoints(img, []byte("seed"), end-start+1, start, end); err == nil {
+		t.Error("picked more points than the window has")
+	}
+}
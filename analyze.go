@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Steganalysis of pixel images, to see how much our own output gives away.
+// Every test looks at one bit plane of one colour channel at a time; plane 1
+// is the LSBs, and plane n looks at the samples shifted right by n-1, so a
+// depth-n embedding shows up in planes 1 to n:
+//
+//   - Westfeld's chi-square attack: LSB replacement evens out the counts of
+//     each value pair 2k, 2k+1. The p-value nears 1 when the pairs are even,
+//     which shows for heavy embedding rather than light scattered bits.
+//   - RS analysis (Fridrich, Goljan and Du) and Sample Pairs analysis
+//     (Dumitrescu, Wu and Wang) each estimate the share of samples that carry
+//     message bits. Around 0 for covers, though smooth or noisy images can be
+//     a few percent off.
+//   - LSB-plane entropy over 8-sample runs, from 0 to 1. Natural images have
+//     some structure in their LSBs; a full payload looks like noise.
+//
+// All of them model LSB replacement. LSB matching (-matching) doesn't even
+// the pairs out, so it mostly gets past them.
+//
+// The alpha bit (-alpha) is counted apart: covers are nearly always fully
+// opaque, so the share of opaque pixels at 254 gives it away.
+//
+// Palette images and JPEGs aren't analyzed, as hide changes palette indices
+// and DCT coefficients in them rather than pixel samples.
+
+// ChannelAnalysis is the result of every test on one channel.
+type ChannelAnalysis struct {
+	Channel    string  `json:"channel"`
+	Plane      int     `json:"plane"` // 1 for the LSBs
+	ChiSquareP float64 `json:"chi_square_p"`
+	RSRate     float64 `json:"rs_rate"`
+	SPARate    float64 `json:"spa_rate"`
+	LSBEntropy float64 `json:"lsb_entropy"`
+	// Rate is the mean of the RS and SPA estimates, clamped to [0, 1]
+	Rate float64 `json:"estimated_rate"`
+}
+
+// ChannelChanges compares one channel of a stego image with its cover.
+type ChannelChanges struct {
+	Channel     string  `json:"channel"`
+	Changed     int     `json:"changed_samples"`
+	ChangedRate float64 `json:"changed_rate"`
+	MaxDiff     int     `json:"max_diff"`
+	PSNR        float64 `json:"psnr_db,omitempty"` // Left out when identical
+}
+
+// AlphaAnalysis looks at the alpha of the pixels -alpha embeds in.
+type AlphaAnalysis struct {
+	Opaque  int `json:"opaque_pixels"` // Alpha 254 or 255
+	Lowered int `json:"alpha_254"`
+	// Rate is twice the share at 254, as half the embedded bits are 1
+	Rate float64 `json:"estimated_rate"`
+}
+
+type AnalysisReport struct {
+	Image    string            `json:"image"`
+	Width    int               `json:"width"`
+	Height   int               `json:"height"`
+	Channels []ChannelAnalysis `json:"channels"` // Plane by plane
+	Alpha    *AlphaAnalysis    `json:"alpha,omitempty"`
+
+	// With -cover
+	Cover   *AnalysisReport  `json:"cover,omitempty"`
+	Changes []ChannelChanges `json:"changes,omitempty"`
+}
+
+// channelPlanes splits img into the colour channels modes embed in: one for
+// gray images, R, G and B otherwise.
+func channelPlanes(img *EditableImage) ([]string, [][]int) {
+	names := []string{"R", "G", "B"}
+	if img.pixelFormat().isGray() {
+		names = []string{"gray"}
+	}
+
+	w, h := img.Width(), img.Height()
+	planes := make([][]int, len(names))
+	for c := range planes {
+		planes[c] = make([]int, 0, w*h)
+		for y := 0; y < h; y++ {
+			row := img.Img.Pix[y*img.Img.Stride:]
+			for x := 0; x < w; x++ {
+				planes[c] = append(planes[c], int(row[x*4+c]))
+			}
+		}
+	}
+	return names, planes
+}
+
+// NewAnalysisReport runs every test on bit planes 1 to depth of every
+// channel of img, and looks at alpha if img has it.
+func NewAnalysisReport(path string, img *EditableImage, depth int) AnalysisReport {
+	report := AnalysisReport{Image: path, Width: img.Width(), Height: img.Height()}
+	names, planes := channelPlanes(img)
+	shifted := make([]int, img.Width()*img.Height())
+	for bit := 0; bit < depth; bit++ {
+		for c, plane := range planes {
+			for i, v := range plane {
+				shifted[i] = v >> bit
+			}
+			rs := rsAnalysis(shifted, img.Width())
+			spa := samplePairs(shifted, img.Width())
+			report.Channels = append(report.Channels, ChannelAnalysis{
+				Channel:    names[c],
+				Plane:      bit + 1,
+				ChiSquareP: chiSquareAttack(shifted),
+				RSRate:     rs,
+				SPARate:    spa,
+				LSBEntropy: lsbEntropy(shifted, img.Width()),
+				Rate:       min(max((rs+spa)/2, 0), 1),
+			})
+		}
+	}
+	if img.pixelFormat().hasAlpha() {
+		report.Alpha = alphaAnalysis(img)
+	}
+	return report
+}
+
+// alphaAnalysis counts the opaque pixels of img at 254.
+func alphaAnalysis(img *EditableImage) *AlphaAnalysis {
+	a := &AlphaAnalysis{}
+	for y := 0; y < img.Height(); y++ {
+		row := img.Img.Pix[y*img.Img.Stride:]
+		for x := 0; x < img.Width(); x++ {
+			switch row[x*4+3] {
+			case 254:
+				a.Lowered++
+				a.Opaque++
+			case 255:
+				a.Opaque++
+			}
+		}
+	}
+	if a.Opaque > 0 {
+		a.Rate = min(2*float64(a.Lowered)/float64(a.Opaque), 1)
+	}
+	return a
+}
+
+// compareImages counts the samples stego changed in each channel of cover.
+func compareImages(cover, stego *EditableImage) ([]ChannelChanges, error) {
+	if cover.Width() != stego.Width() || cover.Height() != stego.Height() {
+		return nil, errors.New("cover and image differ in size")
+	}
+	names, coverPlanes := channelPlanes(cover)
+	_, stegoPlanes := channelPlanes(stego)
+	if len(coverPlanes) != len(stegoPlanes) {
+		return nil, errors.New("cover and image differ in colour type")
+	}
+
+	var changes []ChannelChanges
+	for c := range coverPlanes {
+		change := ChannelChanges{Channel: names[c]}
+		sumSquares := 0.0
+		for i, v := range coverPlanes[c] {
+			d := stegoPlanes[c][i] - v
+			if d != 0 {
+				change.Changed++
+				change.MaxDiff = max(change.MaxDiff, d, -d)
+				sumSquares += float64(d * d)
+			}
+		}
+		n := len(coverPlanes[c])
+		if n > 0 {
+			change.ChangedRate = float64(change.Changed) / float64(n)
+		}
+		if sumSquares > 0 {
+			change.PSNR = 10 * math.Log10(255*255/(sumSquares/float64(n)))
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// chiSquareAttack is the p-value of the samples' value pairs being even.
+// Pairs with fewer than 10 samples between them are left out.
+func chiSquareAttack(samples []int) float64 {
+	var hist [256]int
+	for _, v := range samples {
+		hist[v]++
+	}
+
+	chi, cells := 0.0, 0
+	for k := 0; k < 128; k++ {
+		expected := float64(hist[2*k]+hist[2*k+1]) / 2
+		if expected < 5 {
+			continue
+		}
+		d := float64(hist[2*k]) - expected
+		chi += d * d / expected
+		cells++
+	}
+	if cells < 2 {
+		return 0
+	}
+	return gammaQ(float64(cells-1)/2, chi/2)
+}
+
+// rsAnalysis estimates the embedding rate from how flipping LSBs changes the
+// smoothness of groups of four neighbouring samples in a row.
+func rsAnalysis(samples []int, width int) float64 {
+	flipped := make([]int, len(samples))
+	for i, v := range samples {
+		flipped[i] = v ^ 1
+	}
+
+	mask := [4]int{0, 1, 1, 0}
+	negMask := [4]int{0, -1, -1, 0}
+	d0 := rsDifference(samples, width, mask)
+	d1 := rsDifference(flipped, width, mask)
+	dn0 := rsDifference(samples, width, negMask)
+	dn1 := rsDifference(flipped, width, negMask)
+
+	// Quadratic in z from the paper; the root nearer 0 is the one
+	a := 2 * (d1 + d0)
+	b := dn0 - dn1 - d1 - 3*d0
+	c := d0 - dn0
+	var z float64
+	switch disc := b*b - 4*a*c; {
+	case math.Abs(a) < 1e-12:
+		if b == 0 {
+			return 0
+		}
+		z = -c / b
+	case disc < 0:
+		z = -b / (2 * a)
+	default:
+		z1 := (-b + math.Sqrt(disc)) / (2 * a)
+		z2 := (-b - math.Sqrt(disc)) / (2 * a)
+		z = z1
+		if math.Abs(z2) < math.Abs(z1) {
+			z = z2
+		}
+	}
+	if z == 0.5 {
+		return 0
+	}
+	return z / (z - 0.5)
+}
+
+// rsDifference is the share of regular minus singular groups under mask: 1
+// flips LSBs (0↔1, 2↔3, ...), -1 shifts the other way (-1↔0, 1↔2, ...).
+func rsDifference(samples []int, width int, mask [4]int) float64 {
+	smoothness := func(g [4]int) int {
+		s := 0
+		for i := 0; i < 3; i++ {
+			s += max(g[i+1]-g[i], g[i]-g[i+1])
+		}
+		return s
+	}
+
+	regular, singular, groups := 0, 0, 0
+	for row := 0; row+width <= len(samples); row += width {
+		for x := 0; x+4 <= width; x += 4 {
+			var g, flipped [4]int
+			copy(g[:], samples[row+x:])
+			for i, m := range mask {
+				switch m {
+				case 1:
+					flipped[i] = g[i] ^ 1
+				case -1:
+					flipped[i] = (g[i] + 1) ^ 1 - 1
+				default:
+					flipped[i] = g[i]
+				}
+			}
+			before, after := smoothness(g), smoothness(flipped)
+			switch {
+			case after > before:
+				regular++
+			case after < before:
+				singular++
+			}
+			groups++
+		}
+	}
+	if groups == 0 {
+		return 0
+	}
+	return float64(regular-singular) / float64(groups)
+}
+
+// samplePairs is the Sample Pairs estimate over horizontally adjacent
+// samples (u, v). It is the smaller root of
+// |C0|/2 p² + (2|X| - |P|) p + |Y| - |X| = 0.
+func samplePairs(samples []int, width int) float64 {
+	var x, y, c0, pairs float64
+	for row := 0; row+width <= len(samples); row += width {
+		for i := row; i+1 < row+width; i++ {
+			u, v := samples[i], samples[i+1]
+			switch {
+			case v%2 == 0 && u < v, v%2 == 1 && u > v:
+				x++
+			case v%2 == 0 && u > v, v%2 == 1 && u < v:
+				y++
+			}
+			if u/2 == v/2 {
+				c0++
+			}
+			pairs++
+		}
+	}
+
+	a, b, c := c0/2, 2*x-pairs, y-x
+	if a == 0 {
+		if b == 0 {
+			return 0
+		}
+		return -c / b
+	}
+	disc := b*b - 4*a*c
+	if disc < 0 {
+		return -b / (2 * a)
+	}
+	return min((-b+math.Sqrt(disc))/(2*a), (-b-math.Sqrt(disc))/(2*a))
+}
+
+// lsbEntropy is the entropy of runs of 8 LSBs along each row, over 8 bits.
+func lsbEntropy(samples []int, width int) float64 {
+	var counts [256]int
+	total := 0
+	for row := 0; row+width <= len(samples); row += width {
+		for x := 0; x+8 <= width; x += 8 {
+			symbol := 0
+			for _, v := range samples[row+x : row+x+8] {
+				symbol = symbol<<1 | v&1
+			}
+			counts[symbol]++
+			total++
+		}
+	}
+
+	h := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(total)
+			h -= p * math.Log2(p)
+		}
+	}
+	return h / 8
+}
+
+// gammaQ is the regularized upper incomplete gamma function Q(a, x), so the
+// chi-square survival function is gammaQ(dof/2, chi/2). Series below a+1,
+// continued fraction above, as in Numerical Recipes.
+func gammaQ(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	lgammaA, _ := math.Lgamma(a)
+	prefix := math.Exp(-x + a*math.Log(x) - lgammaA)
+
+	if x < a+1 {
+		sum, term := 1/a, 1/a
+		for n := 1; n < 1000 && math.Abs(term) > math.Abs(sum)*1e-15; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+		}
+		return max(1-sum*prefix, 0)
+	}
+
+	// Modified Lentz
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < 1000; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+	return prefix * h
+}
+
+// loadPixelImage loads a cover that analyze can look at.
+func loadPixelImage(path string) (*EditableImage, error) {
+	c, err := LoadCarrier(path)
+	if err != nil {
+		return nil, err
+	}
+	img, ok := c.(*EditableImage)
+	if !ok {
+		return nil, fmt.Errorf("%s: analyze works on PNG, BMP and TIFF pixels, not palette images or JPEGs", path)
+	}
+	return img, nil
+}
+
+func handleAnalyze(args []string) {
+	cmd := flag.NewFlagSet("analyze", flag.ExitOnError)
+	imgPath := cmd.String("i", "", "Path to the PNG, BMP or TIFF image to analyze (palette images and JPEGs aren't supported)")
+	coverPath := cmd.String("cover", "", "Also analyze this cover and compare the image with it")
+	depth := cmd.Int("depth", 1, fmt.Sprintf("Analyze bit planes 1 to this, up to %d, for -depth embeddings", MaxEmbedDepth))
+	asJSON := cmd.Bool("json", false, "Print the report as JSON")
+	cmd.Parse(args)
+
+	if *imgPath == "" {
+		fmt.Println("Error: -i is required.")
+		cmd.PrintDefaults()
+		os.Exit(1)
+	}
+	if *depth < 1 || *depth > MaxEmbedDepth {
+		fmt.Printf("Error: -depth must be between 1 and %d.\n", MaxEmbedDepth)
+		os.Exit(1)
+	}
+
+	img, err := loadPixelImage(*imgPath)
+	if err != nil {
+		fmt.Println("Image Load Error:", err)
+		os.Exit(1)
+	}
+	report := NewAnalysisReport(*imgPath, img, *depth)
+
+	if *coverPath != "" {
+		cover, err := loadPixelImage(*coverPath)
+		if err != nil {
+			fmt.Println("Cover Load Error:", err)
+			os.Exit(1)
+		}
+		if report.Changes, err = compareImages(cover, img); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		coverReport := NewAnalysisReport(*coverPath, cover, *depth)
+		report.Cover = &coverReport
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+
+	printChannels := func(r *AnalysisReport) {
+		fmt.Printf("Image: %s (%dx%d)\n", r.Image, r.Width, r.Height)
+		fmt.Println("  channel  plane  chi² p  RS rate  SPA rate  LSB entropy  est. rate")
+		for _, c := range r.Channels {
+			fmt.Printf("  %-7s %6d %7.3f %8.3f %9.3f %12.4f %10.3f\n", c.Channel, c.Plane, c.ChiSquareP, c.RSRate, c.SPARate, c.LSBEntropy, c.Rate)
+		}
+		if a := r.Alpha; a != nil {
+			fmt.Printf("  alpha: %d of %d opaque pixels at 254, est. rate %.3f\n", a.Lowered, a.Opaque, a.Rate)
+		}
+	}
+	printChannels(&report)
+	if report.Cover != nil {
+		printChannels(report.Cover)
+		fmt.Println("Changes from the cover:")
+		for i, c := range report.Changes {
+			psnr := "identical"
+			if c.PSNR > 0 {
+				psnr = fmt.Sprintf("PSNR %.1f dB", c.PSNR)
+			}
+			fmt.Printf("  %-7s %d samples (%.2f%%), max ±%d, %s; est. rate %+.3f\n",
+				c.Channel, c.Changed, c.ChangedRate*100, c.MaxDiff, psnr, report.Channels[i].Rate-report.Cover.Channels[i].Rate)
+		}
+	}
+	fmt.Println("Estimated rates above about 0.05 suggest LSB replacement; LSB matching mostly gets past these tests.")
+}
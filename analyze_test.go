@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// smoothCover is a photo-like cover: gentle gradients with a little noise,
+// fully opaque.
+func smoothCover(w, h int, seed int64) *EditableImage {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			for c := 0; c < 3; c++ {
+				v := 128 + 60*math.Sin(float64(x+40*c)/23) + 50*math.Cos(float64(y-30*c)/17) + rng.NormFloat64()*2
+				p[c] = uint8(min(max(v, 0), 255))
+			}
+			p[3] = 255
+		}
+	}
+	return &EditableImage{Img: img}
+}
+
+// embedLSBs replaces the low depth bits of a share rate of the RGB samples
+// with random ones, or moves them by ±1 as -matching does.
+func embedLSBs(img *EditableImage, rate float64, depth int, matching bool, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	mask := uint8(1)<<depth - 1
+	for i, v := range img.Img.Pix {
+		if i%4 == 3 || rng.Float64() >= rate {
+			continue
+		}
+		bits := uint8(rng.Intn(1 << depth))
+		switch {
+		case !matching:
+			img.Img.Pix[i] = v&^mask | bits
+		case v&1 != bits&1 && (v == 0 || v < 255 && rng.Intn(2) == 0):
+			img.Img.Pix[i] = v + 1
+		case v&1 != bits&1:
+			img.Img.Pix[i] = v - 1
+		}
+	}
+}
+
+// planeRates is the estimated rate of each channel in plane.
+func planeRates(report AnalysisReport, plane int) []float64 {
+	var rates []float64
+	for _, c := range report.Channels {
+		if c.Plane == plane {
+			rates = append(rates, c.Rate)
+		}
+	}
+	return rates
+}
+
+func TestAnalysisEstimates(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rate     float64
+		depth    int
+		matching bool
+		// Estimates per plane, and how far off they may be
+		want []float64
+		tol  float64
+	}{
+		{"cover", 0, 1, false, []float64{0, 0}, 0.04},
+		{"full", 1, 1, false, []float64{0.95, 0}, 0.07},
+		{"quarter", 0.25, 1, false, []float64{0.25, 0}, 0.05},
+		{"matching", 1, 1, true, []float64{0.01, 0}, 0.05},
+		// Noise in bit 1 blurs the plane 1 estimate
+		{"depth 2", 1, 2, false, []float64{0.9, 0.95}, 0.12},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := smoothCover(300, 200, 1)
+			embedLSBs(img, tc.rate, tc.depth, tc.matching, 2)
+			report := NewAnalysisReport("x.png", img, len(tc.want))
+			if len(report.Channels) != 3*len(tc.want) {
+				t.Fatalf("%d channels for %d planes", len(report.Channels), len(tc.want))
+			}
+			for plane, want := range tc.want {
+				for c, got := range planeRates(report, plane+1) {
+					if math.Abs(got-want) > tc.tol {
+						t.Errorf("plane %d, %s: estimated %.3f, want %.2f±%.2f", plane+1, report.Channels[c].Channel, got, want, tc.tol)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAlphaAnalysis(t *testing.T) {
+	img := smoothCover(100, 100, 3)
+	if a := NewAnalysisReport("x.png", img, 1).Alpha; a == nil || a.Opaque != 100*100 || a.Rate != 0 {
+		t.Fatalf("cover alpha %+v", a)
+	}
+
+	// Half the opaque pixels carry a bit, and half of those lowered
+	img.Img.Pix[3] = 128
+	rng := rand.New(rand.NewSource(4))
+	for i := 7; i < len(img.Img.Pix); i += 4 {
+		if rng.Intn(2) == 0 {
+			img.Img.Pix[i] -= uint8(rng.Intn(2))
+		}
+	}
+	a := NewAnalysisReport("x.png", img, 1).Alpha
+	if a.Opaque != 100*100-1 || math.Abs(a.Rate-0.5) > 0.05 {
+		t.Errorf("alpha %+v, want a rate near 0.5", a)
+	}
+}
+
+func TestAnalyzeCommand(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := keyPair(t, dir, "bob")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	img := smoothCover(300, 200, 5)
+	img.Img.Pix[3] = 0 // So the PNG keeps its alpha
+	writeTestPNG(t, cover, img.Img)
+	file := filepath.Join(dir, "random.bin")
+	randomFile(t, file, 15000, 1)
+	mustRun(t, nil, "hide", "-i", cover, "-k", pub, "-tf", file, "-alpha", "-o", out)
+
+	var report AnalysisReport
+	msg := mustRun(t, nil, "analyze", "-i", out, "-cover", cover, "-depth", "2", "-json")
+	if err := json.Unmarshal([]byte(msg), &report); err != nil {
+		t.Fatalf("analyze -json: %v\n%s", err, msg)
+	}
+	if len(report.Channels) != 6 || report.Cover == nil || len(report.Changes) != 3 || report.Alpha == nil {
+		t.Fatalf("report %s", msg)
+	}
+	for c, rate := range planeRates(report, 1) {
+		if cover := planeRates(*report.Cover, 1)[c]; rate < 0.2 || cover > 0.05 {
+			t.Errorf("%s: estimated %.3f, cover %.3f", report.Channels[c].Channel, rate, cover)
+		}
+	}
+	if report.Alpha.Rate < 0.2 || report.Cover.Alpha.Lowered != 0 {
+		t.Errorf("alpha %+v, cover alpha %+v", report.Alpha, report.Cover.Alpha)
+	}
+
+	text := mustRun(t, nil, "analyze", "-i", cover)
+	if !strings.Contains(text, "alpha: 0 of 59999 opaque pixels at 254") {
+		t.Errorf("text report:\n%s", text)
+	}
+}
+
+func TestAnalyzeErrors(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.png")
+	writeTestPNG(t, cover, smoothCover(50, 50, 6).Img)
+	palette := filepath.Join(dir, "palette.png")
+	writeTestPNG(t, palette, noisyPaletted(50, 50, smallPalette(16), 7))
+
+	for _, args := range [][]string{
+		{},
+		{"-i", filepath.Join(dir, "missing.png")},
+		{"-i", cover, "-depth", "5"},
+		{"-i", cover, "-cover", palette},
+		{"-i", palette},
+	} {
+		if out, ok := imgcrypt(t, nil, append([]string{"analyze"}, args...)...); ok {
+			t.Errorf("%v: exited 0:\n%s", args, out)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/draw"
+	"image/png"
+	"math/rand"
+	"os"
+)
+
+// Images hidden by the original imgcrypt, from before header slots, have no
+// version to tell them apart, so reveal falls back to this reader when no
+// slot opens. That format is read only, never written: one recipient, text
+// in PNG only, and the body and header are AES-128-ECB with PKCS#7 padding
+// and no authentication, so a damaged image can't be told from a wrong key.
+//
+// The header is the ephemeral public key (65 bytes, uncompressed) and the
+// encrypted body size (one block), in the first SplitPoint pixels in the
+// order math/rand gives for baselineMasterSeed. The AES key is the first 16
+// bytes of the SHA-256 of the ECDH secret, and the body pixels follow, in
+// the order seeded by the FNV-1a hash of that key. Each pixel carries the
+// low bits of R, G and B.
+const (
+	baselineMasterSeed int64 = 1234567890
+	baselinePubKeySize       = 65
+	baselineBlockSize        = 16
+	baselineHeaderSize       = baselinePubKeySize + baselineBlockSize
+)
+
+// revealBaseline reads the text hidden at path for receiverPriv by the
+// original format.
+func revealBaseline(path string, receiverPriv *ecdh.PrivateKey) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	src, err := png.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// The original read pixels premultiplied, as image.RGBA holds them
+	bounds := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(img, img.Bounds(), src, bounds.Min, draw.Src)
+	total := bounds.Dx() * bounds.Dy()
+	if total <= SplitPoint {
+		return nil, errors.New("image too small for the original format")
+	}
+
+	headerBits, err := baselineReadBits(img, baselineMasterSeed, baselineHeaderSize*8, 0, SplitPoint)
+	if err != nil {
+		return nil, err
+	}
+	header := BitsToBytes(headerBits)
+
+	ephemPub, err := ecdh.P256().NewPublicKey(header[:baselinePubKeySize])
+	if err != nil {
+		return nil, ErrTampered
+	}
+	sharedSecret, err := receiverPriv.ECDH(ephemPub)
+	if err != nil {
+		return nil, err
+	}
+	fullHash := sha256.Sum256(sharedSecret)
+	key := fullHash[:16]
+
+	sizeBlock, err := baselineDecrypt(header[baselinePubKeySize:], key)
+	if err != nil || len(sizeBlock) < 4 {
+		return nil, ErrTampered
+	}
+	bodySize := int(int32(binary.LittleEndian.Uint32(sizeBlock)))
+	if bodySize <= 0 || bodySize%baselineBlockSize != 0 || bodySize*8 > 3*(total-SplitPoint) {
+		return nil, ErrTampered
+	}
+
+	h := fnv.New64a()
+	h.Write(key)
+	bodyBits, err := baselineReadBits(img, int64(h.Sum64()), bodySize*8, SplitPoint, total)
+	if err != nil {
+		return nil, err
+	}
+	return baselineDecrypt(BitsToBytes(bodyBits), key)
+}
+
+// baselineReadBits reads nbits from the low bits of R, G and B of pixels
+// drawn from [start, end) by math/rand.
+func baselineReadBits(img *image.RGBA, seed int64, nbits, start, end int) ([]int, error) {
+	perm := rand.New(rand.NewSource(seed)).Perm(end - start)
+	pixels := (nbits + 2) / 3
+	if pixels > len(perm) {
+		return nil, fmt.Errorf("not enough pixels for %d bits", nbits)
+	}
+
+	w := img.Bounds().Dx()
+	bits := make([]int, 0, 3*pixels)
+	for _, offset := range perm[:pixels] {
+		idx := start + offset
+		p := img.Pix[img.PixOffset(idx%w, idx/w):]
+		bits = append(bits, int(p[0]&1), int(p[1]&1), int(p[2]&1))
+	}
+	return bits[:nbits], nil
+}
+
+// baselineDecrypt undoes AES-128-ECB with PKCS#7 padding.
+func baselineDecrypt(data, key []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%baselineBlockSize != 0 {
+		return nil, errors.New("ciphertext is not whole blocks")
+	}
+	plain := make([]byte, 0, len(data))
+	for off := 0; off < len(data); off += baselineBlockSize {
+		block, err := aesDecryptBlock(data[off:off+baselineBlockSize], key)
+		if err != nil {
+			return nil, err
+		}
+		plain = append(plain, block...)
+	}
+
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > baselineBlockSize {
+		return nil, errors.New("bad padding")
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("bad padding")
+		}
+	}
+	return plain[:len(plain)-padding], nil
+}
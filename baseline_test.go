@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/baseline.png was hidden by the original imgcrypt, before header
+// slots, for testdata/baseline_private.pem.
+const baselineText = "Written by the original imgcrypt, before header slots."
+
+func TestRevealBaselineImage(t *testing.T) {
+	got := mustRun(t, nil, "reveal", "-k", filepath.Join("testdata", "baseline_private.pem"), "-i", filepath.Join("testdata", "baseline.png"), "-text")
+	if !strings.Contains(got, baselineText) {
+		t.Errorf("reveal printed:\n%s", got)
+	}
+
+	// Those images have no signature to check
+	_, signPub := keyPair(t, t.TempDir(), "alice")
+	if _, ok := imgcrypt(t, nil, "reveal", "-k", filepath.Join("testdata", "baseline_private.pem"), "-i", filepath.Join("testdata", "baseline.png"), "-text", "-verify", signPub); ok {
+		t.Error("an image from before signatures passed -verify")
+	}
+}
+
+func TestRevealBaselineWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	priv, _ := keyPair(t, dir, "eve")
+	keyObj, _, err := LoadECCKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revealBaseline(filepath.Join("testdata", "baseline.png"), keyObj.(*ecdh.PrivateKey)); err == nil {
+		t.Error("another key read the image")
+	}
+}
+
+// Images in the current format are not mistaken for the original one.
+func TestBaselineIgnoresCurrentImages(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 3))
+	mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-t", "current")
+
+	keyObj, _, err := LoadECCKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revealBaseline(out, keyObj.(*ecdh.PrivateKey)); err == nil {
+		t.Error("current image read as the original format")
+	}
+}
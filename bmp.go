@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	bmpRGB       = 0
+	bmpBitfields = 3
+)
+
+// parseBMP handles uncompressed 24 and 32-bit BMPs, bottom-up or top-down.
+// 32-bit files only have alpha when their bitfield masks say so.
+func parseBMP(data []byte) (*rawFormat, error) {
+	if len(data) < 14+40 {
+		return nil, errors.New("bmp: file too short")
+	}
+	le := binary.LittleEndian
+	pixelOffset := int(le.Uint32(data[10:]))
+	dib := data[14:]
+	headerSize := int(le.Uint32(dib))
+	if headerSize < 40 || 14+headerSize > len(data) {
+		return nil, errors.New("bmp: unsupported header")
+	}
+
+	width := int(int32(le.Uint32(dib[4:])))
+	height := int(int32(le.Uint32(dib[8:])))
+	bpp := int(le.Uint16(dib[14:]))
+	compression := le.Uint32(dib[16:])
+
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+
+	f := &rawFormat{extension: ".bmp", raw: data, width: width, height: height}
+
+	switch {
+	case bpp == 24 && compression == bmpRGB:
+		f.pixelSize, f.channels = 3, [4]int{2, 1, 0, -1}
+	case bpp == 32 && compression == bmpRGB:
+		// The fourth byte is padding in plain 32-bit files
+		f.pixelSize, f.channels = 4, [4]int{2, 1, 0, -1}
+	case bpp == 32 && compression == bmpBitfields:
+		// Masks follow a 40-byte header, or sit inside a V4/V5 header
+		if 14+40+16 > len(data) {
+			return nil, errors.New("bmp: missing bitfield masks")
+		}
+		masks := dib[40:]
+		f.pixelSize = 4
+		for c := 0; c < 4; c++ {
+			mask := le.Uint32(masks[4*c:])
+			if c == 3 && (mask == 0 || headerSize < 56) {
+				f.channels[3] = -1
+				continue
+			}
+			pos := -1
+			for b := 0; b < 4; b++ {
+				if mask == 0xFF<<(8*b) {
+					pos = b
+				}
+			}
+			if pos < 0 {
+				return nil, fmt.Errorf("bmp: unsupported bitfield mask %08x", mask)
+			}
+			f.channels[c] = pos
+		}
+	default:
+		return nil, fmt.Errorf("bmp: only uncompressed 24 and 32-bit images are supported (got %d-bit, compression %d)", bpp, compression)
+	}
+
+	// Rows are padded to a multiple of four bytes
+	stride := (width*f.pixelSize + 3) &^ 3
+	if width <= 0 || height <= 0 || pixelOffset < 0 || pixelOffset > len(data) || height > (len(data)-pixelOffset)/stride {
+		return nil, errors.New("bmp: image too large or truncated")
+	}
+	f.rowOffset = make([]int, height)
+	for y := range f.rowOffset {
+		row := height - 1 - y
+		if topDown {
+			row = y
+		}
+		f.rowOffset[y] = pixelOffset + row*stride
+	}
+	return f, nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+type ModeCapacity struct {
+	Mode         string `json:"mode"`
+	BitsPerPixel int    `json:"bits_per_pixel"`
+	BodyBits     int    `json:"body_bits"`      // Of the smallest image
+	MaxTextBytes int    `json:"max_text_bytes"` // Of -t text, stored as is
+	EstTextBytes int    `json:"est_text_bytes"` // Of -t text that compresses like prose
+
+	// Set by -tf: the most data of that file, stored as is, and with -matrix
+	// the Hamming k hide would pick for it
+	MaxFileBytes *int `json:"max_file_bytes,omitempty"`
+	MatrixK      int  `json:"matrix_k,omitempty"`
+}
+
+// ImageSize is one carrier of a capacity report.
+type ImageSize struct {
+	Image        string `json:"image"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	HeaderPixels int    `json:"header_pixels"`
+	BodyPixels   int    `json:"body_pixels"`
+}
+
+type CapacityReport struct {
+	Images        []ImageSize    `json:"images"`
+	Spare         int            `json:"spare,omitempty"`
+	Overhead      int            `json:"overhead_bytes"`
+	TextContainer int            `json:"text_container_bytes"`
+	FileContainer int            `json:"file_container_bytes,omitempty"`
+	Modes         []ModeCapacity `json:"modes"`
+
+	// The hide options the sizes allow for
+	Signed     bool `json:"signed,omitempty"`
+	Parity     int  `json:"fec_parity,omitempty"`
+	DecoyBytes int  `json:"decoy_bytes,omitempty"`
+
+	// Set by -tf: the file's size, and its packed and compressed size. The
+	// packed size less file_container_bytes compares with max_file_bytes.
+	PayloadFile   string `json:"payload_file,omitempty"`
+	PayloadData   int    `json:"payload_data_bytes,omitempty"`
+	PayloadPacked int    `json:"payload_bytes,omitempty"`
+}
+
+// CapacityOptions are the hide options that take room from the payload.
+type CapacityOptions struct {
+	Signed bool
+	Parity int    // Reed–Solomon parity bytes per codeword, as for -fec
+	Decoy  []byte // Packed decoy payload, nil for none
+	Needed int    // Images reveal needs, as for -spare; 0 is taken as 1
+	Matrix bool   // Report the Hamming k for the -tf payload, as for -matrix
+}
+
+// typicalTextRatio is roughly what DEFLATE gets on prose and source code.
+// Random or already compressed data gets nothing.
+const typicalTextRatio = 3
+
+// bodyPixelCount is how many pixels are left for the body once the header
+// region is reserved.
+func bodyPixelCount(img *EditableImage) int {
+	return max(img.Width()*img.Height()-SplitPoint, 0)
+}
+
+// bodyRoom is the largest encrypted body, or shard of one, hide can fit in c
+// with mode and opts. The decoy is counted with plain embedding.
+func bodyRoom(c Carrier, mode EmbeddingMode, opts CapacityOptions) int {
+	bits := c.BodyCapacityBits(mode)
+	if opts.Decoy != nil {
+		decoyBits := fecEncodedSize(decoySize(opts.Decoy, opts.Signed), opts.Parity) * 8
+		perCell := c.MaxBitsPerCell(mode)
+		bits -= (decoyBits + perCell - 1) / perCell * perCell
+	}
+	room := fecDataSize(max(bits, 0)/8, opts.Parity)
+	if opts.Signed {
+		room -= SignatureSize
+	}
+	return max(room, 0)
+}
+
+// payloadRoom is the largest packed payload hide can split across carriers,
+// each with its mode. Shards are all the same size, so the smallest image
+// sets the limit.
+func payloadRoom(carriers []Carrier, modes []EmbeddingMode, opts CapacityOptions) int {
+	shardRoom := -1
+	for i, c := range carriers {
+		room := bodyRoom(c, modes[i], opts)
+		if shardRoom < 0 || room < shardRoom {
+			shardRoom = room
+		}
+	}
+	return max(max(opts.Needed, 1)*shardRoom-AEADOverhead, 0)
+}
+
+// MaxPlaintextSize is the most data hide can fit in carriers with modes and
+// opts, packed in a container like container and stored uncompressed.
+func MaxPlaintextSize(carriers []Carrier, modes []EmbeddingMode, opts CapacityOptions, container *Payload) int {
+	return max(payloadRoom(carriers, modes, opts)-container.Overhead(), 0)
+}
+
+// matrixK is the Hamming k hide -matrix picks for a packedSize payload in c,
+// after fitting the decoy the way hide does.
+func matrixK(c Carrier, mode EmbeddingMode, opts CapacityOptions, packedSize int) int {
+	embeddedSize := shardSize(packedSize+AEADOverhead, max(opts.Needed, 1))
+	if opts.Signed {
+		embeddedSize += SignatureSize
+	}
+	embeddedBits := fecEncodedSize(embeddedSize, opts.Parity) * 8
+	capacity := c.BodyCapacityBits(mode)
+	if opts.Decoy != nil {
+		decoyBits := fecEncodedSize(decoySize(opts.Decoy, opts.Signed), opts.Parity) * 8
+		coverBits := matrixCoverBits(decoyBits, chooseMatrixK(decoyBits, capacity-embeddedBits))
+		perCell := c.MaxBitsPerCell(mode)
+		capacity -= (coverBits + perCell - 1) / perCell * perCell
+	}
+	return chooseMatrixK(embeddedBits, capacity)
+}
+
+// NewCapacityReport describes carriers, each holding one shard, for -t text
+// and, when file is not nil, for that file. Only the modes of the first
+// carrier that all of them take are listed. For JPEG carriers the pixel
+// counts are counts of usable coefficients.
+func NewCapacityReport(paths []string, carriers []Carrier, opts CapacityOptions, file *Payload) (CapacityReport, error) {
+	text := NewTextPayload("")
+	report := CapacityReport{
+		Overhead:      AEADOverhead,
+		TextContainer: text.Overhead(),
+		Signed:        opts.Signed,
+		Parity:        opts.Parity,
+		DecoyBytes:    len(opts.Decoy),
+	}
+	if opts.Needed > 0 {
+		report.Spare = len(carriers) - opts.Needed
+	}
+	for i, c := range carriers {
+		report.Images = append(report.Images, ImageSize{
+			Image:        paths[i],
+			Width:        c.Width(),
+			Height:       c.Height(),
+			HeaderPixels: c.HeaderCells(),
+			BodyPixels:   c.BodyCells(),
+		})
+	}
+
+	var packed []byte
+	if file != nil {
+		var err error
+		if packed, err = file.MarshalBinary(); err != nil {
+			return report, err
+		}
+		report.FileContainer = file.Overhead()
+		report.PayloadData = len(file.Data)
+		report.PayloadPacked = len(packed)
+	}
+
+modes:
+	for _, base := range carriers[0].Modes() {
+		modes := make([]EmbeddingMode, len(carriers))
+		smallest := 0
+		for i, c := range carriers {
+			var err error
+			if modes[i], err = c.CheckMode(base); err != nil {
+				continue modes
+			}
+			if c.BodyCapacityBits(modes[i]) < carriers[smallest].BodyCapacityBits(modes[smallest]) {
+				smallest = i
+			}
+		}
+
+		maxText := MaxPlaintextSize(carriers, modes, opts, text)
+		m := ModeCapacity{
+			Mode:         base.Name,
+			BitsPerPixel: carriers[0].MaxBitsPerCell(modes[0]),
+			BodyBits:     carriers[smallest].BodyCapacityBits(modes[smallest]),
+			MaxTextBytes: maxText,
+			EstTextBytes: maxText * typicalTextRatio,
+		}
+		if file != nil {
+			maxFile := MaxPlaintextSize(carriers, modes, opts, file)
+			m.MaxFileBytes = &maxFile
+			if opts.Matrix && len(packed) <= payloadRoom(carriers, modes, opts) {
+				m.MatrixK = MaxMatrixK
+				for i, c := range carriers {
+					m.MatrixK = min(m.MatrixK, matrixK(c, modes[i], opts, len(packed)))
+				}
+			}
+		}
+		report.Modes = append(report.Modes, m)
+	}
+	return report, nil
+}
+
+// capacityFail reports err and exits, as a JSON object under -json so the
+// output stays machine readable.
+func capacityFail(asJSON bool, err string) {
+	if asJSON {
+		json.NewEncoder(os.Stdout).Encode(map[string]string{"error": err})
+	} else {
+		fmt.Println("Error:", err)
+	}
+	os.Exit(1)
+}
+
+func handleCapacity(args []string) {
+	cmd := flag.NewFlagSet("capacity", flag.ExitOnError)
+	var imgPaths stringList
+	cmd.Var(&imgPaths, "i", "Path to input image (repeat for the images hide would split a payload across)")
+	asJSON := cmd.Bool("json", false, "Print the report, or the error, as JSON")
+	textFile := cmd.String("tf", "", "Also report the limit for this file, and whether it fits after compression")
+	signed := cmd.Bool("sign", false, "Leave room for a signature, as hide -sign does")
+	fecParity := cmd.Int("fec", 0, "Leave room for this many Reed–Solomon parity bytes per codeword, as hide -fec does")
+	spare := cmd.Int("spare", 0, "With several -i, how many of the images reveal can do without, as hide -spare")
+	useMatrix := cmd.Bool("matrix", false, "With -tf, report the Hamming k hide -matrix would use")
+	decoyText := cmd.String("decoy-t", "", "Leave room for this decoy text, as hide -decoy-t does")
+	decoyFile := cmd.String("decoy-tf", "", "Leave room for this decoy file, as hide -decoy-tf does")
+	cmd.Parse(args)
+
+	if len(imgPaths) == 0 {
+		if !*asJSON {
+			cmd.PrintDefaults()
+		}
+		capacityFail(*asJSON, "-i is required")
+	}
+	if len(imgPaths) > MaxShards {
+		capacityFail(*asJSON, fmt.Sprintf("at most %d images (-i) per payload", MaxShards))
+	}
+	if *spare < 0 || *spare >= len(imgPaths) {
+		capacityFail(*asJSON, "-spare must be less than the number of images (-i)")
+	}
+	if *fecParity < 0 || *fecParity > MaxFECParity {
+		capacityFail(*asJSON, fmt.Sprintf("-fec must be between 0 and %d", MaxFECParity))
+	}
+	if *useMatrix && *textFile == "" {
+		capacityFail(*asJSON, "-matrix needs -tf, as the k hide picks depends on the payload size")
+	}
+	hasDecoy := *decoyText != "" || *decoyFile != ""
+	if hasDecoy && len(imgPaths) > 1 {
+		capacityFail(*asJSON, "a decoy only works with one image")
+	}
+
+	carriers := make([]Carrier, len(imgPaths))
+	for i, imgPath := range imgPaths {
+		img, err := LoadCarrier(imgPath)
+		if err != nil {
+			capacityFail(*asJSON, fmt.Sprintf("loading %s: %v", imgPath, err))
+		}
+		carriers[i] = img
+	}
+
+	opts := CapacityOptions{Signed: *signed, Parity: *fecParity, Needed: len(imgPaths) - *spare, Matrix: *useMatrix}
+	if hasDecoy {
+		decoy := NewTextPayload(*decoyText)
+		if *decoyFile != "" {
+			var err error
+			if decoy, err = NewFilePayload(*decoyFile); err != nil {
+				capacityFail(*asJSON, fmt.Sprintf("reading decoy file: %v", err))
+			}
+		}
+		var err error
+		if opts.Decoy, err = decoy.MarshalBinary(); err != nil {
+			capacityFail(*asJSON, fmt.Sprintf("packing decoy: %v", err))
+		}
+	}
+
+	var file *Payload
+	if *textFile != "" {
+		var err error
+		if file, err = NewFilePayload(*textFile); err != nil {
+			capacityFail(*asJSON, fmt.Sprintf("reading file: %v", err))
+		}
+	}
+
+	report, err := NewCapacityReport(imgPaths, carriers, opts, file)
+	if err != nil {
+		capacityFail(*asJSON, fmt.Sprintf("packing payload: %v", err))
+	}
+	if file != nil {
+		report.PayloadFile = *textFile
+	}
+	if len(report.Modes) == 0 {
+		capacityFail(*asJSON, "no embedding mode suits all of these images")
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+
+	cells, cell := "Pixels", "pixel"
+	if _, ok := carriers[0].(*JPEGImage); ok {
+		cells, cell = "Coefficients", "coef"
+	}
+	for _, size := range report.Images {
+		fmt.Printf("Image: %s (%dx%d)\n", size.Image, size.Width, size.Height)
+		fmt.Printf("Header %s: %d, Body %s: %d\n", cells, size.HeaderPixels, cells, size.BodyPixels)
+	}
+	if len(report.Images) > 1 {
+		fmt.Printf("Split across %d images, any %d of which reveal it\n", len(report.Images), len(report.Images)-report.Spare)
+	}
+	fmt.Printf("Encryption Overhead: %d bytes, Text Container: %d bytes\n", report.Overhead, report.TextContainer)
+	if report.Signed || report.Parity > 0 || report.DecoyBytes > 0 {
+		fmt.Printf("Allowing for: signature %v, %d parity bytes per codeword, %d-byte decoy\n", report.Signed, report.Parity, report.DecoyBytes)
+	}
+	if report.PayloadFile != "" {
+		fmt.Printf("File: %s, %d bytes, %d packed, %d-byte container\n", report.PayloadFile, report.PayloadData, report.PayloadPacked, report.FileContainer)
+	}
+	for _, m := range report.Modes {
+		line := fmt.Sprintf("  %-10s %2d bits/%s  text %d bytes (~%d compressed)", m.Mode, m.BitsPerPixel, cell, m.MaxTextBytes, m.EstTextBytes)
+		if m.MaxFileBytes != nil {
+			fit := "too small"
+			if report.PayloadPacked-report.FileContainer <= *m.MaxFileBytes {
+				fit = "fits"
+			}
+			line += fmt.Sprintf("  file %d bytes, %s", *m.MaxFileBytes, fit)
+			if m.MatrixK > 0 {
+				line += fmt.Sprintf(" (matrix k=%d)", m.MatrixK)
+			}
+		}
+		fmt.Println(line)
+	}
+}
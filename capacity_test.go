@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func capacityJSON(t *testing.T, args ...string) CapacityReport {
+	t.Helper()
+	out := mustRun(t, nil, append([]string{"capacity", "-json"}, args...)...)
+	var report CapacityReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("capacity -json: %v\n%s", err, out)
+	}
+	return report
+}
+
+func findMode(t *testing.T, report CapacityReport, name string) ModeCapacity {
+	t.Helper()
+	for _, m := range report.Modes {
+		if m.Mode == name {
+			return m
+		}
+	}
+	t.Fatalf("no %s mode in %+v", name, report.Modes)
+	return ModeCapacity{}
+}
+
+func randomFile(t *testing.T, path string, size int, seed int64) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	writeFile(t, path, data)
+}
+
+func TestCapacityReport(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 1))
+
+	report := capacityJSON(t, "-i", cover)
+	if len(report.Images) != 1 || report.Images[0].Width != 120 || report.Images[0].Height != 100 {
+		t.Fatalf("images %+v", report.Images)
+	}
+	if report.Images[0].HeaderPixels+report.Images[0].BodyPixels != 120*100 {
+		t.Errorf("header %d and body %d pixels of %d", report.Images[0].HeaderPixels, report.Images[0].BodyPixels, 120*100)
+	}
+	lsb1 := findMode(t, report, "lsb1-rgb")
+	lsb2 := findMode(t, report, "lsb2-rgb")
+	if lsb1.MaxTextBytes <= 0 || lsb2.MaxTextBytes <= lsb1.MaxTextBytes {
+		t.Errorf("text limits %d at depth 1, %d at depth 2", lsb1.MaxTextBytes, lsb2.MaxTextBytes)
+	}
+	if lsb1.MaxFileBytes != nil {
+		t.Error("file limit reported without -tf")
+	}
+
+	// The text report is the same numbers
+	out := mustRun(t, nil, "capacity", "-i", cover)
+	if !strings.Contains(out, fmt.Sprintf("text %d bytes", lsb1.MaxTextBytes)) {
+		t.Errorf("text report missing the lsb1 limit:\n%s", out)
+	}
+
+	// Each option takes room
+	for _, opt := range [][]string{{"-sign"}, {"-fec", "16"}, {"-decoy-t", "nothing here"}} {
+		m := findMode(t, capacityJSON(t, append([]string{"-i", cover}, opt...)...), "lsb1-rgb")
+		if m.MaxTextBytes >= lsb1.MaxTextBytes {
+			t.Errorf("%v: text limit %d, not below %d", opt, m.MaxTextBytes, lsb1.MaxTextBytes)
+		}
+	}
+}
+
+// The file limit is exactly what hide takes, whatever the file's name
+func TestCapacityFileLimitMatchesHide(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := keyPair(t, dir, "bob")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 2))
+	file := filepath.Join(dir, "a-rather-long-file-name.bin")
+	randomFile(t, file, 10, 1)
+
+	m := findMode(t, capacityJSON(t, "-i", cover, "-tf", file), "lsb1-rgb")
+	if m.MaxFileBytes == nil || *m.MaxFileBytes >= m.MaxTextBytes {
+		t.Fatalf("file limit %v, text limit %d", m.MaxFileBytes, m.MaxTextBytes)
+	}
+	limit := *m.MaxFileBytes
+
+	// Random data doesn't compress, so it is stored as is
+	randomFile(t, file, limit, 3)
+	mustRun(t, nil, "hide", "-i", cover, "-k", pub, "-tf", file, "-o", out)
+	randomFile(t, file, limit+1, 3)
+	if msg, ok := imgcrypt(t, nil, "hide", "-i", cover, "-k", pub, "-tf", file, "-o", out); ok {
+		t.Error("hide took a file one byte over the capacity limit")
+	} else if !strings.Contains(msg, fmt.Sprintf("holds at most %d", limit)) {
+		t.Errorf("hide disagrees on the limit:\n%s", msg)
+	}
+}
+
+func TestCapacityShards(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+	writeTestPNG(t, a, noisyRGBA(120, 100, 3))
+	writeTestPNG(t, b, noisyRGBA(110, 100, 4))
+
+	single := findMode(t, capacityJSON(t, "-i", b), "lsb1-rgb")
+	both := capacityJSON(t, "-i", a, "-i", b)
+	if len(both.Images) != 2 {
+		t.Fatalf("images %+v", both.Images)
+	}
+	// b is smaller, so it sets each shard's room
+	shard := single.MaxTextBytes + both.Overhead + both.TextContainer
+	if got := findMode(t, both, "lsb1-rgb").MaxTextBytes; got != 2*shard-both.Overhead-both.TextContainer {
+		t.Errorf("two images hold %d, one %d", got, single.MaxTextBytes)
+	}
+	spare := capacityJSON(t, "-i", a, "-i", b, "-spare", "1")
+	if got := findMode(t, spare, "lsb1-rgb").MaxTextBytes; spare.Spare != 1 || got != single.MaxTextBytes {
+		t.Errorf("with a spare: %d, want %d", got, single.MaxTextBytes)
+	}
+}
+
+func TestCapacityMatrix(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := keyPair(t, dir, "bob")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 5))
+	file := filepath.Join(dir, "small.bin")
+	randomFile(t, file, 200, 4)
+
+	m := findMode(t, capacityJSON(t, "-i", cover, "-tf", file, "-matrix"), "lsb1-rgb")
+	if m.MatrixK < 2 {
+		t.Fatalf("matrix k %d for a small file", m.MatrixK)
+	}
+	msg := mustRun(t, nil, "hide", "-i", cover, "-k", pub, "-tf", file, "-matrix", "-o", out)
+	if !strings.Contains(msg, fmt.Sprintf("Matrix embedding: %d bits", m.MatrixK)) {
+		t.Errorf("capacity said k=%d, hide:\n%s", m.MatrixK, msg)
+	}
+}
+
+func TestCapacityErrors(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 6))
+
+	for _, args := range [][]string{
+		{},
+		{"-i", filepath.Join(dir, "missing.png")},
+		{"-i", cover, "-fec", "-1"},
+		{"-i", cover, "-matrix"},
+		{"-i", cover, "-i", cover, "-decoy-t", "x"},
+	} {
+		out, ok := imgcrypt(t, nil, append([]string{"capacity", "-json"}, args...)...)
+		if ok {
+			t.Errorf("%v: exited 0", args)
+			continue
+		}
+		var reply struct{ Error string }
+		if err := json.Unmarshal([]byte(out), &reply); err != nil || reply.Error == "" {
+			t.Errorf("%v: not a JSON error: %q", args, out)
+		}
+		if _, ok := imgcrypt(t, nil, append([]string{"capacity"}, args...)...); ok {
+			t.Errorf("%v: exited 0 without -json", args)
+		}
+	}
+}
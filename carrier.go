@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Carrier is a cover file that header slots and a body can be hidden in.
+// Pixel images, palette images and JPEG coefficients store bits very
+// differently; hide, reveal and capacity only go through this. A cell is
+// whatever the carrier embeds in: a pixel, or a DCT coefficient.
+type Carrier interface {
+	Width() int
+	Height() int
+
+	// Ext is the usual file extension of the format, e.g. ".png"
+	Ext() string
+
+	// Modes lists the embedding modes capacity reports for this carrier
+	Modes() []EmbeddingMode
+	// CheckMode rejects modes the carrier can't embed with, and returns the
+	// mode under the carrier's own name for it
+	CheckMode(mode EmbeddingMode) (EmbeddingMode, error)
+	// MaxBitsPerCell is the most bits one cell carries in mode
+	MaxBitsPerCell(mode EmbeddingMode) int
+
+	HeaderCells() int
+	BodyCells() int
+	// BodyCapacityBits is how many bits the body region holds in mode
+	BodyCapacityBits(mode EmbeddingMode) int
+
+	// WriteSlot writes one header slot into header window, in an order
+	// fixed by seed, and returns the pixels it touched (if the carrier has
+	// pixels). A non-nil rng switches to LSB matching.
+	WriteSlot(window int, seed []byte, bits []int, rng *keyStream) ([]image.Point, error)
+	ReadSlot(window int, seed []byte, nbits int) ([]int, error)
+
+	// EmbedBody and ExtractBody place the body bits in an order fixed by
+	// seed. rng is only needed for matching modes.
+	EmbedBody(seed []byte, bits []int, mode EmbeddingMode, rng *keyStream) ([]image.Point, error)
+	ExtractBody(seed []byte, nbits int, mode EmbeddingMode) ([]int, error)
+
+	Encode(w io.Writer) error
+	Save(filename string) error
+}
+
+var (
+	pngMagic    = []byte("\x89PNG\r\n\x1a\n")
+	jpegMagic   = []byte{0xFF, 0xD8, 0xFF}
+	bmpMagic    = []byte("BM")
+	tiffMagicLE = []byte("II*\x00")
+	tiffMagicBE = []byte("MM\x00*")
+	gifMagic87  = []byte("GIF87a")
+	gifMagic89  = []byte("GIF89a")
+)
+
+// LoadCarrier opens a cover image, telling the format from its first bytes
+// rather than from the file name.
+func LoadCarrier(filename string) (Carrier, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 8)
+	n, _ := io.ReadFull(file, magic)
+	file.Close()
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, pngMagic):
+		img, err := load_png(filename)
+		if err != nil {
+			return nil, err
+		}
+		return img, nil
+	case bytes.HasPrefix(magic, jpegMagic):
+		img, err := LoadJPEG(filename)
+		if err != nil {
+			return nil, err
+		}
+		return img, nil
+	case bytes.HasPrefix(magic, bmpMagic), bytes.HasPrefix(magic, tiffMagicLE), bytes.HasPrefix(magic, tiffMagicBE):
+		parse := parseBMP
+		if !bytes.HasPrefix(magic, bmpMagic) {
+			parse = parseTIFF
+		}
+		img, err := loadRawImage(filename, parse)
+		if err != nil {
+			return nil, err
+		}
+		return img, nil
+	case bytes.HasPrefix(magic, gifMagic87), bytes.HasPrefix(magic, gifMagic89):
+		img, err := LoadGIF(filename)
+		if err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+	return nil, errors.New("unsupported image format (expected PNG, JPEG, GIF, BMP or TIFF)")
+}
+
+// saveEncoded writes enc to filename atomically: it is encoded into a temp
+// file in the same directory and renamed over the target only once complete,
+// so a crash never leaves a half-written image behind. "-" means stdout.
+func saveEncoded(filename string, enc interface{ Encode(io.Writer) error }) error {
+	if filename == "-" {
+		return enc.Encode(os.Stdout)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".imgcrypt-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if err := enc.Encode(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp uses 0600; the output is an ordinary image
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Carrier methods of pixel images. Bodies and header slots are in embed.go
+// and header.go.
+
+func (img *EditableImage) Ext() string {
+	return img.pixelFormat().ext()
+}
+
+func (img *EditableImage) Modes() []EmbeddingMode {
+	var modes []EmbeddingMode
+	for _, mode := range EmbeddingModes {
+		if mode, err := img.CheckMode(mode); err == nil {
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}
+
+// CheckMode turns mode gray for gray images.
+func (img *EditableImage) CheckMode(mode EmbeddingMode) (EmbeddingMode, error) {
+	format := img.pixelFormat()
+	if mode.Alpha && !format.hasAlpha() {
+		return mode, errors.New("this image has no alpha channel to embed in")
+	}
+	if format.isGray() {
+		mode = mode.Grayscale()
+	}
+	return mode, nil
+}
+
+func (img *EditableImage) MaxBitsPerCell(mode EmbeddingMode) int {
+	return mode.MaxBitsPerPixel()
+}
+
+func (img *EditableImage) HeaderCells() int {
+	return min(SplitPoint, img.Width()*img.Height())
+}
+
+func (img *EditableImage) BodyCells() int {
+	return bodyPixelCount(img)
+}
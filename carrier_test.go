@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// encodeBMP writes a bottom-up 24-bit BMP.
+func encodeBMP(img *image.NRGBA) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	stride := (3*w + 3) &^ 3
+	data := make([]byte, 54+stride*h)
+	le := binary.LittleEndian
+	copy(data, "BM")
+	le.PutUint32(data[2:], uint32(len(data)))
+	le.PutUint32(data[10:], 54)
+	le.PutUint32(data[14:], 40)
+	le.PutUint32(data[18:], uint32(w))
+	le.PutUint32(data[22:], uint32(h))
+	le.PutUint16(data[26:], 1)
+	le.PutUint16(data[28:], 24)
+	for y := 0; y < h; y++ {
+		row := data[54+(h-1-y)*stride:]
+		for x := 0; x < w; x++ {
+			c := img.NRGBAAt(x, y)
+			row[3*x], row[3*x+1], row[3*x+2] = c.B, c.G, c.R
+		}
+	}
+	return data
+}
+
+// encodeTIFF writes a little-endian RGB TIFF with the pixels in one strip.
+func encodeTIFF(img *image.NRGBA) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	pixels := 3 * w * h
+	le := binary.LittleEndian
+
+	tags := [][2]int{
+		{tiffImageWidth, w}, {tiffImageLength, h}, {tiffCompression, 1},
+		{tiffPhotometric, 2}, {tiffStripOffsets, 8}, {tiffSamplesPerPixel, 3},
+		{tiffRowsPerStrip, h}, {tiffStripByteCounts, pixels},
+	}
+	data := make([]byte, 8+pixels+2+12*len(tags)+4)
+	copy(data, "II*\x00")
+	le.PutUint32(data[4:], uint32(8+pixels))
+	for i := 0; i < w*h; i++ {
+		copy(data[8+3*i:], img.Pix[4*i:4*i+3])
+	}
+	ifd := data[8+pixels:]
+	le.PutUint16(ifd, uint16(len(tags)))
+	for i, tag := range tags {
+		entry := ifd[2+12*i:]
+		le.PutUint16(entry, uint16(tag[0]))
+		le.PutUint16(entry[2:], 4)
+		le.PutUint32(entry[4:], 1)
+		le.PutUint32(entry[8:], uint32(tag[1]))
+	}
+	return data
+}
+
+func encodeWith(t *testing.T, enc func(*bytes.Buffer) error) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := enc(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCarrierRoundTrips(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+
+	rgba := noisyRGBA(320, 240, 5)
+
+	covers := []struct {
+		name string
+		data []byte
+	}{
+		{"cover.bmp", encodeBMP(rgba)},
+		{"cover.tif", encodeTIFF(rgba)},
+	}
+	for _, cover := range covers {
+		t.Run(cover.name, func(t *testing.T) {
+			in := filepath.Join(t.TempDir(), cover.name)
+			writeFile(t, in, cover.data)
+			ext := filepath.Ext(cover.name)
+			out := strings.TrimSuffix(in, ext) + "-out" + ext
+
+			mustRun(t, nil, "hide", "-k", pub, "-i", in, "-o", out, "-t", "carried by "+cover.name)
+			if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "carried by "+cover.name) {
+				t.Errorf("reveal printed:\n%s", got)
+			}
+
+			c, err := LoadCarrier(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Width() != 320 || c.Height() != 240 {
+				t.Errorf("stego image is %dx%d", c.Width(), c.Height())
+			}
+		})
+	}
+}
+
+func TestRawFormatRejectsTruncated(t *testing.T) {
+	img := noisyRGBA(40, 30, 6)
+	for _, tt := range []struct {
+		name  string
+		data  []byte
+		parse func([]byte) (*rawFormat, error)
+	}{
+		{"bmp", encodeBMP(img), parseBMP},
+		{"tiff", encodeTIFF(img), parseTIFF},
+	} {
+		if _, err := tt.parse(tt.data); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		// A header that claims a huge image must fail before anything is
+		// allocated for it
+		huge := append([]byte(nil), tt.data...)
+		if tt.name == "bmp" {
+			binary.LittleEndian.PutUint32(huge[22:], 1<<30)
+		} else {
+			binary.LittleEndian.PutUint32(huge[len(huge)-4-12*8+8:], 1<<30)
+		}
+		if _, err := tt.parse(huge); err == nil || !strings.Contains(err.Error(), "too large or truncated") {
+			t.Errorf("%s: huge image: err = %v", tt.name, err)
+		}
+	}
+
+	if _, err := parseBMP(encodeBMP(img)[:54+100]); err == nil {
+		t.Error("bmp: truncated pixel data accepted")
+	}
+}
+
+func TestGIFFrameOffsetRejected(t *testing.T) {
+	frame := image.NewPaletted(image.Rect(5, 5, 15, 15), palette.Plan9)
+	anim := &gif.GIF{
+		Image:  []*image.Paletted{frame},
+		Delay:  []int{0},
+		Config: image.Config{ColorModel: frame.Palette, Width: 20, Height: 20},
+	}
+	path := filepath.Join(t.TempDir(), "offset.gif")
+	writeFile(t, path, encodeWith(t, func(b *bytes.Buffer) error { return gif.EncodeAll(b, anim) }))
+
+	if _, err := LoadCarrier(path); err == nil {
+		t.Error("GIF whose first frame doesn't cover the image accepted")
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ecdh"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 )
 
 type KeyType int
@@ -20,7 +24,9 @@ const (
 	KeyTypePublic
 )
 
-func LoadECCKey(path string) (any, KeyType, error) {
+// LoadECDSAKey parses a PEM key file and keeps the ECDSA form, which is what
+// signing and verification need.
+func LoadECDSAKey(path string) (any, KeyType, error) {
 	keyBytes, err := os.ReadFile(path)
 	if err != nil {
 		return nil, KeyTypeUnknown, fmt.Errorf("could not read key file: %v", err)
@@ -37,11 +43,7 @@ func LoadECCKey(path string) (any, KeyType, error) {
 		if err != nil {
 			return nil, KeyTypeUnknown, fmt.Errorf("failed to parse EC Private Key: %v", err)
 		}
-		privECDH, err := privECDSA.ECDH()
-		if err != nil {
-			return nil, KeyTypeUnknown, fmt.Errorf("failed to convert to ECDH: %v", err)
-		}
-		return privECDH, KeyTypePrivate, nil
+		return privECDSA, KeyTypePrivate, nil
 	case "PUBLIC KEY":
 		pubInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
 		if err != nil {
@@ -51,40 +53,326 @@ func LoadECCKey(path string) (any, KeyType, error) {
 		if !ok {
 			return nil, KeyTypeUnknown, errors.New("key is not an ECC Public Key")
 		}
-		pubECDH, err := pubECDSA.ECDH()
+		return pubECDSA, KeyTypePublic, nil
+	default:
+		return nil, KeyTypeUnknown, fmt.Errorf("unknown key type: %s", block.Type)
+	}
+}
+
+// LoadECCKey loads a key with LoadECDSAKey and converts it for ECDH.
+func LoadECCKey(path string) (any, KeyType, error) {
+	keyObj, kType, err := LoadECDSAKey(path)
+	if err != nil {
+		return nil, kType, err
+	}
+
+	switch k := keyObj.(type) {
+	case *ecdsa.PrivateKey:
+		privECDH, err := k.ECDH()
+		if err != nil {
+			return nil, KeyTypeUnknown, fmt.Errorf("failed to convert to ECDH: %v", err)
+		}
+		return privECDH, kType, nil
+	case *ecdsa.PublicKey:
+		pubECDH, err := k.ECDH()
 		if err != nil {
 			return nil, KeyTypeUnknown, fmt.Errorf("failed to convert to ECDH: %v", err)
 		}
-		return pubECDH, KeyTypePublic, nil
-	default:
-		return nil, KeyTypeUnknown, fmt.Errorf("unknown key type: %s", block.Type)
+		return pubECDH, kType, nil
+	}
+	return nil, KeyTypeUnknown, errors.New("unexpected key object")
+}
+
+// GenerateECCKeyPair creates a new P-256 key pair and returns it PEM encoded
+// in the same "EC PRIVATE KEY" / "PUBLIC KEY" form LoadECCKey expects.
+func GenerateECCKeyPair() (privPEM []byte, pubPEM []byte, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal private key: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal public key: %v", err)
+	}
+
+	privPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDER})
+	pubPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	return privPEM, pubPEM, nil
+}
+
+// KeyFingerprint returns the colon separated SHA-256 of the public key DER.
+func KeyFingerprint(pubPEM []byte) (string, error) {
+	block, _ := pem.Decode(pubPEM)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return "", errors.New("failed to parse PEM block")
+	}
+
+	sum := sha256.Sum256(block.Bytes)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return "SHA256:" + strings.Join(parts, ":"), nil
+}
+
+// WriteKeyFile writes a PEM file with the given permissions. Unless force is
+// set, an existing file is left alone and an error is returned.
+func WriteKeyFile(path string, data []byte, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
 	}
+
+	file, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists (use -f to overwrite)", path)
+		}
+		return err
+	}
+	defer file.Close()
+
+	// OpenFile only applies perm on creation, so tighten overwritten files too
+	if err := file.Chmod(perm); err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	return err
 }
 
-func EncryptAES(plaintext string, password string) ([]byte, error) {
-	keyHash := sha256.Sum256([]byte(password))
-	key := keyHash[:16]
+const (
+	// HeaderVersion is the HeaderMetadata layout new images get. Images
+	// from before header slots have no version; see baseline.go.
+	HeaderVersion = 1
+
+	// HeaderMetadataSize is the plaintext size of HeaderMetadata
+	HeaderMetadataSize = 25
+	// SlotSize is one recipient's header slot: ephemeral key, then the
+	// sealed content key and metadata.
+	SlotSize = EphemeralReprSize + ContentKeySize + HeaderMetadataSize + AEADOverhead
+
+	// A password slot has a random salt, with the scrypt cost in its low
+	// bits, where a key slot has the ephemeral key, so both kinds are the
+	// same size.
+	PasswordSaltSize = EphemeralReprSize
+
+	// DefaultKeySize is the body AES key size for new images (AES-256)
+	DefaultKeySize = 32
+)
+
+// Header flag bits
+const (
+	// HeaderFlagSigned means a SignatureSize signature follows the body
+	HeaderFlagSigned uint8 = 1 << iota
+	// HeaderFlagAlpha means the body also uses alpha on opaque pixels
+	HeaderFlagAlpha
+	// HeaderFlagAdaptive means the body pixels are ordered by texture
+	HeaderFlagAdaptive
+)
+
+// HeaderMetadata is what the encrypted header carries about the body.
+type HeaderMetadata struct {
+	Version  uint8 // HeaderVersion
+	BodySize int32 // Of the whole encrypted body, before it is split into shards
+	KeySize  uint8 // Body AES key size in bytes: 16, 24 or 32
+	Flags    uint8
+	Depth    uint8 // Low bits per channel the body uses
+	MatrixK  uint8 // Hamming code parameter of the body, 1 for none
+
+	// BodyCells is the size of the body region the bits were spread over,
+	// so reveal finds them in the same places after rows are cropped off
+	BodyCells int32
+	// Parity is Reed–Solomon parity bytes per codeword, 0 for none
+	Parity uint8
 
-	return encryptBits([]byte(plaintext), key)
+	// A body split across several images: the ID shared by the set, this
+	// image's place in it, and how many of the images rebuild the body. One
+	// image on its own is shard 0 of 1.
+	SetID        uint32
+	ShardIndex   uint8
+	ShardCount   uint8
+	ShardsNeeded uint8
+
+	// DecoyBits is the cover bits of a decoy body, whose session derives
+	// from this one, and whose cells this body avoids. 0 for none
+	DecoyBits int32
 }
 
-func DecryptAES(encryptedData []byte, password string) (string, error) {
-	keyHash := sha256.Sum256([]byte(password))
-	key := keyHash[:16]
+func (m HeaderMetadata) Signed() bool {
+	return m.Flags&HeaderFlagSigned != 0
+}
 
-	plaintextBytes, err := decryptBits(encryptedData, key)
+// EmbeddingMode is the mode the body was written with.
+func (m HeaderMetadata) EmbeddingMode() (EmbeddingMode, error) {
+	mode, err := NewEmbeddingMode(int(m.Depth), m.Flags&HeaderFlagAlpha != 0)
 	if err != nil {
-		return "", fmt.Errorf("AES decryption failed: %v", err)
+		return mode, err
+	}
+	if m.MatrixK < 1 || m.MatrixK > MaxMatrixK {
+		return mode, fmt.Errorf("unsupported matrix embedding parameter %d", m.MatrixK)
+	}
+	if m.BodyCells < 0 {
+		return mode, errors.New("bad body region size")
+	}
+	mode.MatrixK = int(m.MatrixK)
+	mode.Adaptive = m.Flags&HeaderFlagAdaptive != 0
+	mode.Cells = int(m.BodyCells)
+	return mode, nil
+}
+
+// SetEmbeddingMode records mode for reveal.
+func (m *HeaderMetadata) SetEmbeddingMode(mode EmbeddingMode) {
+	m.Depth = uint8(mode.Depth)
+	m.MatrixK = uint8(mode.MatrixK)
+	m.BodyCells = int32(mode.Cells)
+	m.Flags &^= HeaderFlagAlpha | HeaderFlagAdaptive
+	if mode.Alpha {
+		m.Flags |= HeaderFlagAlpha
+	}
+	if mode.Adaptive {
+		m.Flags |= HeaderFlagAdaptive
+	}
+}
+
+func (m HeaderMetadata) MarshalBinary() ([]byte, error) {
+	if m.Version != HeaderVersion {
+		return nil, fmt.Errorf("unsupported header version %d", m.Version)
+	}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *HeaderMetadata) UnmarshalBinary(data []byte) error {
+	if len(data) != HeaderMetadataSize {
+		return fmt.Errorf("header metadata must be %d bytes", HeaderMetadataSize)
+	}
+	if data[0] != HeaderVersion {
+		return fmt.Errorf("unsupported header version %d", data[0])
 	}
-	return string(plaintextBytes), nil
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, m); err != nil {
+		return err
+	}
+	if !validKeySize(int(m.KeySize)) {
+		return fmt.Errorf("unsupported body key size %d", m.KeySize)
+	}
+	if _, err := m.EmbeddingMode(); err != nil {
+		return err
+	}
+	if m.Parity > MaxFECParity {
+		return fmt.Errorf("unsupported error correction parity %d", m.Parity)
+	}
+	if m.DecoyBits < 0 {
+		return errors.New("bad decoy size")
+	}
+	if m.ShardIndex >= m.ShardCount || m.ShardsNeeded < 1 || m.ShardsNeeded > m.ShardCount {
+		return fmt.Errorf("bad shard %d of %d (%d needed)", m.ShardIndex, m.ShardCount, m.ShardsNeeded)
+	}
+	return nil
 }
 
+// ContentKeySize is the size of the random per-image key that every body key
+// is derived from.
+const ContentKeySize = 32
+
+// EncryptionSession holds the content key for one image. The body is
+// encrypted once under keys derived from it, and the content key itself is
+// wrapped separately for every recipient in the header slots.
 type EncryptionSession struct {
-	EphemeralPriv *ecdh.PrivateKey
-	SharedKey     []byte // The 16-byte AES key
+	ContentKey []byte
+	KeySize    int    // Body AES key size, recorded in the header
+	prk        []byte // HKDF pseudorandom key the body keys expand from
+}
+
+func NewEncryptionSession(keySize int) (*EncryptionSession, error) {
+	if !validKeySize(keySize) {
+		return nil, fmt.Errorf("invalid AES key size %d", keySize)
+	}
+
+	contentKey := make([]byte, ContentKeySize)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, err
+	}
+	return sessionFromContentKey(contentKey, keySize), nil
+}
+
+func sessionFromContentKey(contentKey []byte, keySize int) *EncryptionSession {
+	return &EncryptionSession{
+		ContentKey: contentKey,
+		KeySize:    keySize,
+		// The content key is uniformly random, so Extract needs no salt
+		prk: hkdfExtract(nil, contentKey),
+	}
+}
+
+// wrapKeys derives the AES-256 and MAC keys for one header slot from the ECDH
+// secret. The salt binds them to both public keys taking part in the exchange.
+func wrapKeys(sharedSecret, ephemeralPub, receiverPub []byte) ([]byte, []byte) {
+	salt := append(append([]byte{}, ephemeralPub...), receiverPub...)
+	prk := hkdfExtract(salt, sharedSecret)
+	return hkdfExpand(prk, labelHeaderKey, 32), hkdfExpand(prk, labelHeaderMAC, 32)
+}
+
+// bodyKeys are the AES and MAC keys for the body. The key size is part of the
+// label so an AES-128 key is never a prefix of an AES-256 one.
+func (s *EncryptionSession) bodyKeys() ([]byte, []byte) {
+	label := fmt.Sprintf("%s %d", labelBodyKey, s.KeySize*8)
+	return hkdfExpand(s.prk, label, s.KeySize), hkdfExpand(s.prk, labelBodyMAC, 32)
+}
+
+// PixelSeed is the key material that drives the body pixel layout.
+func (s *EncryptionSession) PixelSeed() []byte {
+	return hkdfExpand(s.prk, labelPixelSeed, 32)
+}
+
+// MatchingStream drives the ±1 choices of LSB matching. Reveal never needs
+// it; it only has to be unpredictable to whoever looks at the image.
+func (s *EncryptionSession) MatchingStream() *keyStream {
+	return newKeyStream(hkdfExpand(s.prk, labelMatchSeed, 32))
+}
+
+// DecoySession is the session of a decoy body hidden next to this one. It
+// is derived one way: whoever holds the decoy can't get back to this body.
+func (s *EncryptionSession) DecoySession() *EncryptionSession {
+	return sessionFromContentKey(hkdfExpand(s.prk, labelDecoyKey, ContentKeySize), s.KeySize)
+}
+
+// HeaderLocationSeed drives where a recipient's slot pixels sit. Only someone
+// who knows the recipient's public key can find them.
+func HeaderLocationSeed(receiverPub *ecdh.PublicKey) []byte {
+	return hkdfExpand(hkdfExtract(nil, receiverPub.Bytes()), labelHeaderSeed, 32)
+}
+
+// PasswordLocationSeed orders the pixels of password slots. It is the same
+// for every image, so a password slot is only hidden among the others by the
+// window it sits in.
+func PasswordLocationSeed() []byte {
+	return hkdfExpand(hkdfExtract(nil, nil), labelPasswordSeed, 32)
+}
+
+// EncryptBody seals the body under the content key.
+func (s *EncryptionSession) EncryptBody(data []byte) ([]byte, error) {
+	key, macKey := s.bodyKeys()
+	return encryptBits(data, key, macKey, nil)
+}
+
+// DecryptBody verifies and opens a body sealed by EncryptBody.
+func (s *EncryptionSession) DecryptBody(sealed []byte) ([]byte, error) {
+	key, macKey := s.bodyKeys()
+	return decryptBits(sealed, key, macKey, nil)
 }
 
-func NewEncryptionSession(receiverPub *ecdh.PublicKey) (*EncryptionSession, error) {
+// WrapFor builds the header slot for one recipient: a fresh ephemeral key in
+// its uniform encoding, followed by the content key and metadata sealed under
+// keys from ECDH with receiverPub.
+func (s *EncryptionSession) WrapFor(receiverPub *ecdh.PublicKey, metadata HeaderMetadata) ([]byte, error) {
 	ephemeralPriv, err := ecdh.P256().GenerateKey(rand.Reader)
 	if err != nil {
 		return nil, err
@@ -95,50 +383,113 @@ func NewEncryptionSession(receiverPub *ecdh.PublicKey) (*EncryptionSession, erro
 		return nil, err
 	}
 
-	fullHash := sha256.Sum256(sharedSecret)
-	aesKey16 := fullHash[:16]
+	ephemeralRepr, err := EncodeEphemeralKey(ephemeralPriv.PublicKey())
+	if err != nil {
+		return nil, err
+	}
 
-	return &EncryptionSession{
-		EphemeralPriv: ephemeralPriv,
-		SharedKey:     aesKey16,
-	}, nil
+	key, macKey := wrapKeys(sharedSecret, ephemeralPriv.PublicKey().Bytes(), receiverPub.Bytes())
+	return s.sealSlot(ephemeralRepr, key, macKey, metadata)
 }
 
-func (s *EncryptionSession) BuildHeader(metadata []byte) ([]byte, error) {
-	encryptedMetadata, err := encryptBits(metadata, s.SharedKey)
+// sealSlot seals the content key and metadata behind prefix, which is
+// authenticated along with them.
+func (s *EncryptionSession) sealSlot(prefix, key, macKey []byte, metadata HeaderMetadata) ([]byte, error) {
+	if int(metadata.KeySize) != s.KeySize {
+		return nil, errors.New("metadata key size does not match the session")
+	}
+	plainMetadata, err := metadata.MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
 
-	return append(s.EphemeralPriv.PublicKey().Bytes(), encryptedMetadata...), nil
+	sealed, err := encryptBits(append(append([]byte{}, s.ContentKey...), plainMetadata...), key, macKey, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, prefix...), sealed...), nil
 }
 
-func ParseHeader(receiverPriv *ecdh.PrivateKey, headerBlob []byte) ([]byte, []byte, error) {
-	const pubKeySize = 65
-	if len(headerBlob) <= pubKeySize {
-		return nil, nil, errors.New("header blob too short")
+// openSlot is the inverse of sealSlot once the slot keys are known.
+func openSlot(prefix, sealed, key, macKey []byte) (*HeaderMetadata, *EncryptionSession, error) {
+	plain, err := decryptBits(sealed, key, macKey, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var metadata HeaderMetadata
+	if err := metadata.UnmarshalBinary(plain[ContentKeySize:]); err != nil {
+		return nil, nil, err
 	}
 
-	ephemPubBytes := headerBlob[:pubKeySize]
-	encryptedMetadata := headerBlob[pubKeySize:]
+	session := sessionFromContentKey(plain[:ContentKeySize], int(metadata.KeySize))
+	return &metadata, session, nil
+}
 
-	ephemPub, err := ecdh.P256().NewPublicKey(ephemPubBytes)
+// passwordKeys runs scrypt and splits the result into slot AES and MAC keys.
+func passwordKeys(password, salt []byte, params ScryptParams) ([]byte, []byte, error) {
+	derived, err := Scrypt(password, salt, params, 64)
 	if err != nil {
 		return nil, nil, err
 	}
+	return derived[:32], derived[32:], nil
+}
 
-	sharedSecret, err := receiverPriv.ECDH(ephemPub)
+// WrapWithPassword builds a password slot: a random salt recording the
+// scrypt cost, then the content key and metadata sealed under keys derived
+// from the password.
+func (s *EncryptionSession) WrapWithPassword(password []byte, params ScryptParams, metadata HeaderMetadata) ([]byte, error) {
+	salt := make([]byte, PasswordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err := setPasswordCost(salt, params); err != nil {
+		return nil, err
+	}
+
+	key, macKey, err := passwordKeys(password, salt, params)
+	if err != nil {
+		return nil, err
+	}
+	return s.sealSlot(salt, key, macKey, metadata)
+}
+
+// ParsePasswordSlot opens a password slot at the cost its salt records. Any
+// other slot reads as some cost too, so each window costs one scrypt run.
+func ParsePasswordSlot(password []byte, slot []byte) (*HeaderMetadata, *EncryptionSession, error) {
+	if len(slot) != SlotSize {
+		return nil, nil, errors.New("header slot has the wrong size")
+	}
+
+	salt := slot[:PasswordSaltSize]
+	key, macKey, err := passwordKeys(password, salt, passwordCost(salt))
 	if err != nil {
 		return nil, nil, err
 	}
+	return openSlot(salt, slot[PasswordSaltSize:], key, macKey)
+}
+
+// ParseHeader opens one header slot with the receiver's key. Slots meant for
+// someone else, and the random filler slots, fail with ErrTampered.
+func ParseHeader(receiverPriv *ecdh.PrivateKey, slot []byte) (*HeaderMetadata, *EncryptionSession, error) {
+	if len(slot) != SlotSize {
+		return nil, nil, errors.New("header slot has the wrong size")
+	}
 
-	fullHash := sha256.Sum256(sharedSecret)
-	aesKey16 := fullHash[:16]
+	ephemRepr := slot[:EphemeralReprSize]
+	sealed := slot[EphemeralReprSize:]
 
-	decryptedMetadata, err := decryptBits(encryptedMetadata, aesKey16)
+	ephemPub, err := DecodeEphemeralKey(ephemRepr)
+	if err != nil {
+		// Random bits where a key should be: treat like a failed tag
+		return nil, nil, ErrTampered
+	}
+
+	sharedSecret, err := receiverPriv.ECDH(ephemPub)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return decryptedMetadata, aesKey16, nil
+	key, macKey := wrapKeys(sharedSecret, ephemPub.Bytes(), receiverPriv.PublicKey().Bytes())
+	return openSlot(ephemRepr, sealed, key, macKey)
 }
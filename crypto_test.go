@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+func testMetadata() HeaderMetadata {
+	return HeaderMetadata{
+		Version: HeaderVersion, BodySize: 1234, KeySize: DefaultKeySize, Flags: HeaderFlagSigned,
+		Depth: 2, MatrixK: 3, BodyCells: 5000, Parity: 16,
+		SetID: 0xdeadbeef, ShardIndex: 1, ShardCount: 3, ShardsNeeded: 2,
+	}
+}
+
+func TestHeaderMetadataRoundTrip(t *testing.T) {
+	m := testMetadata()
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != HeaderMetadataSize || data[0] != HeaderVersion {
+		t.Fatalf("marshalled %d bytes starting %d", len(data), data[0])
+	}
+	var got HeaderMetadata
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if got != m {
+		t.Errorf("got %+v, want %+v", got, m)
+	}
+
+	for name, bad := range map[string][]byte{
+		"short":           data[:HeaderMetadataSize-1],
+		"unknown version": append([]byte{HeaderVersion + 1}, data[1:]...),
+		"bad key size":    func() []byte { b := append([]byte(nil), data...); b[5] = 20; return b }(),
+	} {
+		if err := got.UnmarshalBinary(bad); err == nil {
+			t.Errorf("%s metadata accepted", name)
+		}
+	}
+}
+
+func TestKeySlotRoundTrip(t *testing.T) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := NewEncryptionSession(DefaultKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slot, err := session.WrapFor(priv.PublicKey(), testMetadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slot) != SlotSize {
+		t.Fatalf("slot is %d bytes, want %d", len(slot), SlotSize)
+	}
+	m, opened, err := ParseHeader(priv, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *m != testMetadata() || !bytes.Equal(opened.ContentKey, session.ContentKey) {
+		t.Error("slot opened to different contents")
+	}
+	if _, _, err := ParseHeader(other, slot); err != ErrTampered {
+		t.Errorf("other key: err = %v, want ErrTampered", err)
+	}
+
+	// Each key has its own header pixels
+	if bytes.Equal(HeaderLocationSeed(priv.PublicKey()), HeaderLocationSeed(other.PublicKey())) {
+		t.Error("two keys share a header location seed")
+	}
+}
+
+// The slot records its cost, so it opens without being told
+func TestPasswordSlotRoundTrip(t *testing.T) {
+	session, err := NewEncryptionSession(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testMetadata()
+	m.KeySize = 16
+
+	for _, logN := range PasswordCosts[:2] {
+		params, err := PasswordParams(logN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slot, err := session.WrapWithPassword([]byte("hunter2"), params, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(slot) != SlotSize {
+			t.Fatalf("password slot is %d bytes, want %d", len(slot), SlotSize)
+		}
+		got, opened, err := ParsePasswordSlot([]byte("hunter2"), slot)
+		if err != nil {
+			t.Fatalf("cost %d: %v", logN, err)
+		}
+		if *got != m || !bytes.Equal(opened.ContentKey, session.ContentKey) {
+			t.Errorf("cost %d: slot opened to different contents", logN)
+		}
+		if _, _, err := ParsePasswordSlot([]byte("hunter3"), slot); err != ErrTampered {
+			t.Errorf("cost %d: wrong password: err = %v, want ErrTampered", logN, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+)
+
+// A decoy is a second, harmless payload for keys that can be handed over
+// under pressure. It has its own header slots, which look like any other
+// slot, and its own session, derived one way from the real one (see
+// DecoySession). Its body goes in first; the real metadata records how many
+// cover bits it took, so the real body skips its cells and a real key finds
+// both. A decoy key finds only the decoy: its metadata is that of an
+// ordinary image, and nothing in it leads back to the real session.
+//
+// This hides the real payload from the decoy key, not from steganalysis.
+// An image with a decoy has more changed pixels than the decoy accounts for.
+
+// decoyBody is a decoy ready to be written.
+type decoyBody struct {
+	session *EncryptionSession
+	mode    EmbeddingMode
+	bits    []int // Error correction included
+	slots   []HeaderSlot
+}
+
+// decoySize is the embedded size of data as a decoy, before error
+// correction.
+func decoySize(data []byte, signed bool) int {
+	size := len(data) + AEADOverhead
+	if signed {
+		size += SignatureSize
+	}
+	return size
+}
+
+// newDecoyBody encrypts data under the decoy session of session and wraps it
+// copies times for each of recipients. mode must be the real body's, bar
+// MatrixK.
+func newDecoyBody(session *EncryptionSession, data []byte, recipients []*ecdh.PublicKey, copies int, mode EmbeddingMode, parity int, signKey *ecdsa.PrivateKey) (*decoyBody, error) {
+	decoySession := session.DecoySession()
+	encrypted, err := decoySession.EncryptBody(data)
+	if err != nil {
+		return nil, err
+	}
+	setID, err := newShardSetID()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := HeaderMetadata{
+		Version:      HeaderVersion,
+		BodySize:     int32(len(encrypted)),
+		KeySize:      uint8(decoySession.KeySize),
+		Parity:       uint8(parity),
+		SetID:        setID,
+		ShardCount:   1,
+		ShardsNeeded: 1,
+	}
+	metadata.SetEmbeddingMode(mode)
+
+	embedded := encrypted
+	if signKey != nil {
+		metadata.Flags |= HeaderFlagSigned
+		plainMetadata, _ := metadata.MarshalBinary()
+		sig, err := SignEmbedded(signKey, plainMetadata, encrypted)
+		if err != nil {
+			return nil, err
+		}
+		embedded = append(embedded, sig...)
+	}
+
+	decoy := &decoyBody{
+		session: decoySession,
+		mode:    mode,
+		bits:    BytesToBits(fecEncode(embedded, parity)),
+	}
+	for _, recipient := range recipients {
+		for c := 0; c < copies; c++ {
+			slot, err := decoySession.SlotFor(recipient, metadata)
+			if err != nil {
+				return nil, err
+			}
+			decoy.slots = append(decoy.slots, slot)
+		}
+	}
+	return decoy, nil
+}
+
+// layout is where the decoy sits, for the real body to avoid.
+func (d *decoyBody) layout() *BodyLayout {
+	return &BodyLayout{
+		Seed:      d.session.PixelSeed(),
+		CoverBits: matrixCoverBits(len(d.bits), d.mode.MatrixK),
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"math/big"
+)
+
+// Elligator Squared (Tibouchi, 2014) for P-256.
+//
+// A P-256 public key in the header would be easy to spot: the x-coordinate
+// always has a square right-hand side and the uncompressed form starts with
+// 0x04. Instead we write the ephemeral key as two field elements (u1, u2) with
+// f(u1) + f(u2) = P, where f is the simplified SWU map from RFC 9380. Sampling
+// u1 at random and picking a random preimage of P - f(u1) makes (u1, u2)
+// uniform, so the 64 bytes look like any other random bits.
+
+const (
+	fieldSize = 32
+	// EphemeralReprSize is the size of an encoded ephemeral key in the header
+	EphemeralReprSize = 2 * fieldSize
+)
+
+var (
+	p256P, _ = new(big.Int).SetString("ffffffff00000001000000000000000000000000ffffffffffffffffffffffff", 16)
+	p256A    = new(big.Int).Sub(p256P, big.NewInt(3))
+	p256B, _ = new(big.Int).SetString("5ac635d8aa3a93e7b3ebbd55769886bc651d06b0cc53b0f63bce3c3e27d2604b", 16)
+	// Z for P-256 from RFC 9380, section 8.2
+	sswuZ = new(big.Int).Sub(p256P, big.NewInt(10))
+)
+
+// curvePoint is an affine point; nil stands for the point at infinity.
+type curvePoint struct {
+	X, Y *big.Int
+}
+
+func fAdd(a, b *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Add(a, b), p256P) }
+func fSub(a, b *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Sub(a, b), p256P) }
+func fMul(a, b *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Mul(a, b), p256P) }
+func fNeg(a *big.Int) *big.Int    { return new(big.Int).Mod(new(big.Int).Neg(a), p256P) }
+func fInv(a *big.Int) *big.Int {
+	if a.Sign() == 0 {
+		return new(big.Int) // inv0 from RFC 9380: 0 maps to 0
+	}
+	return new(big.Int).ModInverse(a, p256P)
+}
+func fIsSquare(a *big.Int) bool { return a.Sign() == 0 || big.Jacobi(a, p256P) == 1 }
+func fSqrt(a *big.Int) *big.Int { return new(big.Int).ModSqrt(a, p256P) }
+func sgn0(a *big.Int) uint      { return a.Bit(0) }
+
+// curveRHS is x^3 + A*x + B.
+func curveRHS(x *big.Int) *big.Int {
+	return fAdd(fAdd(fMul(fMul(x, x), x), fMul(p256A, x)), p256B)
+}
+
+// sswuMap is map_to_curve_simple_swu from RFC 9380, section 6.6.2.
+func sswuMap(u *big.Int) *curvePoint {
+	u2 := fMul(u, u)
+	zu2 := fMul(sswuZ, u2)
+	tv1 := fInv(fAdd(fMul(zu2, zu2), zu2))
+
+	var x1 *big.Int
+	if tv1.Sign() == 0 {
+		x1 = fMul(p256B, fInv(fMul(sswuZ, p256A)))
+	} else {
+		x1 = fMul(fMul(fNeg(p256B), fInv(p256A)), fAdd(big.NewInt(1), tv1))
+	}
+
+	x, gx := x1, curveRHS(x1)
+	if !fIsSquare(gx) {
+		x = fMul(zu2, x1)
+		gx = curveRHS(x)
+	}
+
+	y := fSqrt(gx)
+	if sgn0(u) != sgn0(y) {
+		y = fNeg(y)
+	}
+	return &curvePoint{X: x, Y: y}
+}
+
+// sswuPreimages returns every u with sswuMap(u) == pt (at most four).
+func sswuPreimages(pt *curvePoint) []*big.Int {
+	// Both branches of the map reduce to a quadratic in w = u^2. Solve them
+	// and keep the square roots that really map back to pt.
+	c := fMul(pt.X, fMul(fNeg(p256A), fInv(p256B)))
+	one := big.NewInt(1)
+
+	var ws []*big.Int
+
+	// x = x1: 1 + 1/(Z^2 w^2 + Z w) = c, so Z^2 w^2 + Z w - 1/(c-1) = 0
+	if t := fSub(c, one); t.Sign() != 0 {
+		z2 := fMul(sswuZ, sswuZ)
+		ws = append(ws, solveQuadratic(z2, sswuZ, fNeg(fInv(t)))...)
+	}
+
+	// x = Z w x1: with t = Z w, t^2 + (1-c) t + (1-c) = 0
+	oneMinusC := fSub(one, c)
+	for _, t := range solveQuadratic(one, oneMinusC, oneMinusC) {
+		ws = append(ws, fMul(t, fInv(sswuZ)))
+	}
+
+	var preimages []*big.Int
+	for _, w := range ws {
+		if w.Sign() == 0 || !fIsSquare(w) {
+			continue
+		}
+		u := fSqrt(w)
+		if sgn0(u) != sgn0(pt.Y) {
+			u = fNeg(u)
+		}
+		if mapped := sswuMap(u); mapped.X.Cmp(pt.X) != 0 || mapped.Y.Cmp(pt.Y) != 0 {
+			continue
+		}
+		duplicate := false
+		for _, seen := range preimages {
+			if seen.Cmp(u) == 0 {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			preimages = append(preimages, u)
+		}
+	}
+	return preimages
+}
+
+// solveQuadratic returns the roots of a*w^2 + b*w + c = 0 in the field.
+func solveQuadratic(a, b, c *big.Int) []*big.Int {
+	disc := fSub(fMul(b, b), fMul(big.NewInt(4), fMul(a, c)))
+	if !fIsSquare(disc) {
+		return nil
+	}
+	s := fSqrt(disc)
+	inv2a := fInv(fMul(big.NewInt(2), a))
+	r1 := fMul(fSub(s, b), inv2a)
+	r2 := fMul(fSub(fNeg(s), b), inv2a)
+	if r1.Cmp(r2) == 0 {
+		return []*big.Int{r1}
+	}
+	return []*big.Int{r1, r2}
+}
+
+// pointAdd adds two affine points with the textbook formulas.
+func pointAdd(a, b *curvePoint) *curvePoint {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+
+	var lambda *big.Int
+	if a.X.Cmp(b.X) == 0 {
+		if fAdd(a.Y, b.Y).Sign() == 0 {
+			return nil
+		}
+		// Doubling: (3x^2 + A) / 2y
+		num := fAdd(fMul(big.NewInt(3), fMul(a.X, a.X)), p256A)
+		lambda = fMul(num, fInv(fMul(big.NewInt(2), a.Y)))
+	} else {
+		lambda = fMul(fSub(b.Y, a.Y), fInv(fSub(b.X, a.X)))
+	}
+
+	x := fSub(fSub(fMul(lambda, lambda), a.X), b.X)
+	y := fSub(fMul(lambda, fSub(a.X, x)), a.Y)
+	return &curvePoint{X: x, Y: y}
+}
+
+// randomFieldElement draws uniformly from [0, p).
+func randomFieldElement() (*big.Int, error) {
+	buf := make([]byte, fieldSize)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		u := new(big.Int).SetBytes(buf)
+		if u.Cmp(p256P) < 0 {
+			return u, nil
+		}
+	}
+}
+
+// EncodeEphemeralKey returns a random-looking 64-byte encoding of pub.
+func EncodeEphemeralKey(pub *ecdh.PublicKey) ([]byte, error) {
+	raw := pub.Bytes() // 0x04 || X || Y
+	target := &curvePoint{
+		X: new(big.Int).SetBytes(raw[1 : 1+fieldSize]),
+		Y: new(big.Int).SetBytes(raw[1+fieldSize:]),
+	}
+
+	for {
+		u1, err := randomFieldElement()
+		if err != nil {
+			return nil, err
+		}
+
+		f1 := sswuMap(u1)
+		rest := pointAdd(target, &curvePoint{X: f1.X, Y: fNeg(f1.Y)})
+		if rest == nil {
+			continue
+		}
+
+		// Keep a preimage with probability |preimages|/4, as the paper
+		// requires for the output to be uniform
+		preimages := sswuPreimages(rest)
+		var pick [1]byte
+		if _, err := rand.Read(pick[:]); err != nil {
+			return nil, err
+		}
+		j := int(pick[0] % 4)
+		if j >= len(preimages) {
+			continue
+		}
+
+		repr := make([]byte, EphemeralReprSize)
+		u1.FillBytes(repr[:fieldSize])
+		preimages[j].FillBytes(repr[fieldSize:])
+		return repr, nil
+	}
+}
+
+// DecodeEphemeralKey maps a 64-byte encoding back to the P-256 public key.
+func DecodeEphemeralKey(repr []byte) (*ecdh.PublicKey, error) {
+	if len(repr) != EphemeralReprSize {
+		return nil, errors.New("encoded key has the wrong size")
+	}
+
+	u1 := new(big.Int).Mod(new(big.Int).SetBytes(repr[:fieldSize]), p256P)
+	u2 := new(big.Int).Mod(new(big.Int).SetBytes(repr[fieldSize:]), p256P)
+
+	pt := pointAdd(sswuMap(u1), sswuMap(u2))
+	if pt == nil {
+		return nil, errors.New("encoded key is the point at infinity")
+	}
+
+	raw := make([]byte, 1+2*fieldSize)
+	raw[0] = 0x04
+	pt.X.FillBytes(raw[1 : 1+fieldSize])
+	pt.Y.FillBytes(raw[1+fieldSize:])
+	return ecdh.P256().NewPublicKey(raw)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+func TestEphemeralKeyRoundTrip(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		priv, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repr, err := EncodeEphemeralKey(priv.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(repr) != EphemeralReprSize {
+			t.Fatalf("encoding is %d bytes", len(repr))
+		}
+		pub, err := DecodeEphemeralKey(repr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pub.Equal(priv.PublicKey()) {
+			t.Fatal("decoded a different key")
+		}
+
+		// The encoding is randomised, so the same key looks different
+		again, err := EncodeEphemeralKey(priv.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(again, repr) {
+			t.Error("two encodings of one key are equal")
+		}
+	}
+}
+
+// Any 64 bytes decode to some key, so a header slot can't be told apart
+// from noise by trying to decode it.
+func TestDecodeRandomRepr(t *testing.T) {
+	repr := make([]byte, EphemeralReprSize)
+	for i := 0; i < 16; i++ {
+		rand.Read(repr)
+		if _, err := DecodeEphemeralKey(repr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := DecodeEphemeralKey(repr[:63]); err == nil {
+		t.Error("short encoding accepted")
+	}
+}
+
+func TestSSWUPreimages(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		u, err := randomFieldElement()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt := sswuMap(u)
+		if fMul(pt.Y, pt.Y).Cmp(curveRHS(pt.X)) != 0 {
+			t.Fatal("sswuMap gave a point off the curve")
+		}
+		found := false
+		for _, v := range sswuPreimages(pt) {
+			back := sswuMap(v)
+			if back.X.Cmp(pt.X) != 0 || back.Y.Cmp(pt.Y) != 0 {
+				t.Fatal("preimage maps to another point")
+			}
+			found = found || v.Cmp(u) == 0
+		}
+		if !found {
+			t.Error("u is not among the preimages of its own point")
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"slices"
+	"strings"
+)
+
+// MaxEmbedDepth is the most low bits per channel a mode may use. Past four
+// the changes start to show on flat areas.
+const MaxEmbedDepth = 4
+
+// EmbeddingMode describes how the body bits are spread over its pixels.
+type EmbeddingMode struct {
+	Name  string
+	Depth int  // Low bits used in every channel, 1 to MaxEmbedDepth
+	Alpha bool // Also use alpha on opaque pixels
+
+	// Matching changes values by ±1 (±2^Depth) instead of overwriting the
+	// low bits. Reveal reads both the same way, so it isn't recorded.
+	Matching bool
+
+	// MatrixK is the Hamming code parameter: MatrixK message bits per
+	// 2^MatrixK - 1 embedded bits. 1 is plain embedding.
+	MatrixK int
+
+	// Adaptive orders the body pixels by texture instead of uniformly
+	Adaptive bool
+
+	// Gray embeds in a single colour channel. It comes from the carrier,
+	// not the header, see Grayscale.
+	Gray bool
+
+	// Cells is the size of the body region at hide time, 0 for the whole
+	// of the carrier's. Cells past the end of a cropped image read as
+	// unknown (-1) bits. Adaptive modes and alpha can't survive cropping:
+	// the texture map changes, and a lost pixel's bit count is unknown.
+	Cells int
+
+	// Avoid is a decoy body already in the carrier, written in the same
+	// mode. This body skips the cells it takes.
+	Avoid *BodyLayout
+}
+
+// BodyLayout is enough to find a body's cells again: the seed that orders
+// them and how many cover bits it takes.
+type BodyLayout struct {
+	Seed      []byte
+	CoverBits int
+}
+
+// bodyOffsets picks count offsets into a body region of window cells in
+// seed order, skipping any that mode.Avoid takes. For carriers with one bit
+// per cell.
+func bodyOffsets(seed []byte, count, window int, mode EmbeddingMode) ([]int, error) {
+	var avoid map[int]bool
+	if mode.Avoid != nil {
+		if mode.Avoid.CoverBits > window {
+			return nil, errors.New("decoy body does not fit this image")
+		}
+		avoid = make(map[int]bool, mode.Avoid.CoverBits)
+		for _, offset := range newKeyStream(mode.Avoid.Seed).shuffledPrefix(window, mode.Avoid.CoverBits) {
+			avoid[offset] = true
+		}
+	}
+	if count+len(avoid) > window {
+		return nil, errors.New("not enough usable cells to hold all bits")
+	}
+	picked := make([]int, 0, count)
+	for _, offset := range newKeyStream(seed).shuffledPrefix(window, count+len(avoid)) {
+		if !avoid[offset] && len(picked) < count {
+			picked = append(picked, offset)
+		}
+	}
+	return picked, nil
+}
+
+// NewEmbeddingMode checks depth and names the mode, e.g. "lsb2-rgba".
+func NewEmbeddingMode(depth int, alpha bool) (EmbeddingMode, error) {
+	if depth < 1 || depth > MaxEmbedDepth {
+		return EmbeddingMode{}, fmt.Errorf("embedding depth must be between 1 and %d", MaxEmbedDepth)
+	}
+	channels := "rgb"
+	if alpha {
+		channels = "rgba"
+	}
+	return EmbeddingMode{Name: fmt.Sprintf("lsb%d-%s", depth, channels), Depth: depth, Alpha: alpha, MatrixK: 1}, nil
+}
+
+// Grayscale is m for a carrier whose pixels have one colour channel, e.g.
+// "lsb1-gray".
+func (m EmbeddingMode) Grayscale() EmbeddingMode {
+	m.Gray = true
+	m.Name = strings.Replace(m.Name, "rgb", "gray", 1)
+	return m
+}
+
+// DefaultEmbeddingMode is 1 LSB of R, G and B. Header slots use it (see
+// slotMode), since the body's mode is only known once a slot is open.
+var DefaultEmbeddingMode, _ = NewEmbeddingMode(1, false)
+
+// EmbeddingModes lists every mode capacity reports on.
+var EmbeddingModes = func() []EmbeddingMode {
+	var modes []EmbeddingMode
+	for _, alpha := range []bool{false, true} {
+		for depth := 1; depth <= MaxEmbedDepth; depth++ {
+			mode, _ := NewEmbeddingMode(depth, alpha)
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}()
+
+// matchValue returns the value nearest to v whose low depth bits are target,
+// choosing at random between two equally near ones. With depth 1 that is
+// v+1 or v-1 (only one of them at 0 and 255), so values are no longer paired
+// up as 2k <-> 2k+1 the way LSB replacement pairs them. keepHigh rules out
+// candidates that carry into the bits the adaptive cost map reads.
+func matchValue(v, target uint8, depth int, keepHigh bool, rng *keyStream) uint8 {
+	step := 1 << depth
+	base := int(v)&^(step-1) | int(target)
+
+	var nearest []int
+	bestDist := 256
+	for _, c := range []int{base - step, base, base + step} {
+		if c < 0 || c > 255 || (keepHigh && c>>costShift != int(v>>costShift)) {
+			continue
+		}
+		dist := c - int(v)
+		if dist < 0 {
+			dist = -dist
+		}
+		if dist < bestDist {
+			nearest, bestDist = nearest[:0], dist
+		}
+		if dist == bestDist {
+			nearest = append(nearest, c)
+		}
+	}
+
+	if len(nearest) == 1 {
+		return uint8(nearest[0])
+	}
+	return uint8(nearest[rng.Intn(len(nearest))])
+}
+
+// alphaDepth is how many bits alpha carries: one, whatever the depth. Only
+// the bits above it decide whether alpha is used, so the answer is the same
+// before and after embedding, and a fixed depth keeps that to alpha 254 and
+// 255.
+const alphaDepth = 1
+
+// usesAlpha reports whether the alpha of p carries bits: only for opaque
+// pixels, which embedding leaves at 254 or 255.
+func (m EmbeddingMode) usesAlpha(p Pixel) bool {
+	return m.Alpha && p.A>>alphaDepth == 0xff>>alphaDepth
+}
+
+// colourChannels is 1 for gray modes and 3 otherwise.
+func (m EmbeddingMode) colourChannels() int {
+	if m.Gray {
+		return 1
+	}
+	return 3
+}
+
+// BitsAt is how many bits pixel p carries in this mode.
+func (m EmbeddingMode) BitsAt(p Pixel) int {
+	if m.usesAlpha(p) {
+		return m.colourChannels()*m.Depth + alphaDepth
+	}
+	return m.colourChannels() * m.Depth
+}
+
+// MaxBitsPerPixel is BitsAt for an opaque pixel.
+func (m EmbeddingMode) MaxBitsPerPixel() int {
+	if m.Alpha {
+		return m.colourChannels()*m.Depth + alphaDepth
+	}
+	return m.colourChannels() * m.Depth
+}
+
+// pointsFor is how many body pixels to draw for nbits: enough even if no
+// pixel has usable alpha, capped at the window. Reveal draws the same number,
+// and the writer simply stops early when alpha helps.
+func (m EmbeddingMode) pointsFor(nbits, window int) int {
+	perPixel := m.colourChannels() * m.Depth
+	return min((nbits+perPixel-1)/perPixel, window)
+}
+
+// BodyCapacityBits is how many bits the body region of img holds in mode.
+func (img *EditableImage) BodyCapacityBits(mode EmbeddingMode) int {
+	if !mode.Alpha {
+		return bodyPixelCount(img) * mode.MaxBitsPerPixel()
+	}
+
+	total := 0
+	for idx := SplitPoint; idx < img.Width()*img.Height(); idx++ {
+		total += mode.BitsAt(img.GetPixel(idx%img.Width(), idx/img.Width()))
+	}
+	return total
+}
+
+// bodyPoints draws the body pixels for nbits in the order fixed by seed.
+func bodyPoints(img *EditableImage, seed []byte, nbits int, mode EmbeddingMode) ([]image.Point, error) {
+	totalPixels := img.Width() * img.Height()
+	window := totalPixels - SplitPoint
+	if mode.Cells > 0 && !mode.Adaptive {
+		window = mode.Cells
+	}
+	if window <= 0 {
+		return nil, errors.New("image has no room for a body")
+	}
+
+	// Draw as many more as the decoy has, then drop the decoy's
+	var avoid map[image.Point]bool
+	if mode.Avoid != nil {
+		decoy := mode
+		decoy.Avoid = nil
+		points, err := bodyPoints(img, mode.Avoid.Seed, mode.Avoid.CoverBits, decoy)
+		if err != nil {
+			return nil, errors.New("decoy body does not fit this image")
+		}
+		avoid = make(map[image.Point]bool, len(points))
+		for _, pt := range points {
+			avoid[pt] = true
+		}
+	}
+	if window-len(avoid) <= 0 {
+		return nil, errors.New("image has no room for a body")
+	}
+	count := mode.pointsFor(nbits, window-len(avoid))
+
+	var points []image.Point
+	var err error
+	if mode.Adaptive {
+		points, err = GenerateAdaptivePoints(img, seed, count+len(avoid), SplitPoint, totalPixels)
+	} else {
+		points, err = GeneratePointsInRange(img.Width(), img.Height(), seed, count+len(avoid), SplitPoint, SplitPoint+window)
+	}
+	if err != nil || avoid == nil {
+		return points, err
+	}
+	return slices.DeleteFunc(points, func(pt image.Point) bool { return avoid[pt] })[:count], nil
+}
+
+// EmbedBody writes bits into the body region and returns the pixels used.
+// rng is only needed for matching modes.
+func (img *EditableImage) EmbedBody(seed []byte, bits []int, mode EmbeddingMode, rng *keyStream) ([]image.Point, error) {
+	coverBits := matrixCoverBits(len(bits), mode.MatrixK)
+	points, err := bodyPoints(img, seed, coverBits, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	cover := ReadBitsAtPoints(img, points, mode)
+	if len(cover) < coverBits {
+		return nil, errors.New("not enough points to hold all bits")
+	}
+	stego := matrixEmbed(cover[:coverBits], bits, mode.MatrixK)
+
+	used, err := WriteBitsAtPoints(img, stego, points, mode, rng)
+	if err != nil {
+		return nil, err
+	}
+	return points[:used], nil
+}
+
+// ExtractBody reads back nbits written by EmbedBody.
+func (img *EditableImage) ExtractBody(seed []byte, nbits int, mode EmbeddingMode) ([]int, error) {
+	coverBits := matrixCoverBits(nbits, mode.MatrixK)
+	points, err := bodyPoints(img, seed, coverBits, mode)
+	if err != nil {
+		return nil, err
+	}
+	stego := ReadBitsAtPoints(img, points, mode)
+	if len(stego) < coverBits {
+		return nil, errors.New("recovered body size does not fit this image")
+	}
+	return matrixExtract(stego[:coverBits], nbits, mode.MatrixK), nil
+}
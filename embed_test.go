@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewEmbeddingMode(t *testing.T) {
+	for _, tt := range []struct {
+		depth int
+		alpha bool
+		name  string
+	}{
+		{1, false, "lsb1-rgb"},
+		{4, false, "lsb4-rgb"},
+		{2, true, "lsb2-rgba"},
+	} {
+		mode, err := NewEmbeddingMode(tt.depth, tt.alpha)
+		if err != nil || mode.Name != tt.name || mode.Depth != tt.depth || mode.Alpha != tt.alpha {
+			t.Errorf("NewEmbeddingMode(%d, %v) = %+v, %v", tt.depth, tt.alpha, mode, err)
+		}
+		if gray := mode.Grayscale(); !gray.Gray || !strings.Contains(gray.Name, "gray") {
+			t.Errorf("%s as grayscale: %+v", tt.name, gray)
+		}
+	}
+	for _, depth := range []int{0, MaxEmbedDepth + 1} {
+		if _, err := NewEmbeddingMode(depth, false); err == nil {
+			t.Errorf("depth %d accepted", depth)
+		}
+	}
+}
+
+// Alpha carries one bit on opaque pixels only, and embedding can't change
+// which pixels those are
+func TestUsesAlpha(t *testing.T) {
+	mode, _ := NewEmbeddingMode(3, true)
+	for a := 0; a < 256; a++ {
+		p := Pixel{A: uint8(a)}
+		want := a >= 254
+		if got := mode.usesAlpha(p); got != want {
+			t.Errorf("alpha %d: usesAlpha = %v", a, got)
+		}
+		if n := len(p.channels(mode)); (n == 4) != want {
+			t.Errorf("alpha %d: %d channels", a, n)
+		}
+	}
+	plain, _ := NewEmbeddingMode(3, false)
+	if plain.usesAlpha(Pixel{A: 255}) {
+		t.Error("alpha used without -alpha")
+	}
+}
+
+func TestMatchValue(t *testing.T) {
+	rng := newKeyStream(make([]byte, 32))
+	for depth := 1; depth <= MaxEmbedDepth; depth++ {
+		step := 1 << depth
+		for v := 0; v < 256; v++ {
+			for target := 0; target < step; target++ {
+				got := int(matchValue(uint8(v), uint8(target), depth, false, rng))
+				if got&(step-1) != target {
+					t.Fatalf("depth %d: %d to %d has low bits %d", depth, v, got, got&(step-1))
+				}
+				// Only at the ends can the nearest candidate be out of range
+				limit := step / 2
+				if v < step || v > 255-step {
+					limit = step - 1
+				}
+				if dist := abs(got - v); dist > limit {
+					t.Fatalf("depth %d: %d moved to %d for target %d", depth, v, got, target)
+				}
+				if v&(step-1) == target && got != v {
+					t.Fatalf("depth %d: %d changed though it held %d", depth, v, target)
+				}
+			}
+		}
+	}
+	// Clamped at the ends
+	if got := matchValue(0, 1, 1, false, rng); got != 1 {
+		t.Errorf("0 matched to %d", got)
+	}
+	if got := matchValue(255, 0, 1, false, rng); got != 254 {
+		t.Errorf("255 matched to %d", got)
+	}
+}
+
+// LSB replacement moves values only within the pairs 2k, 2k+1, so their
+// counts even out, which is what chi-square steganalysis looks for. LSB
+// matching spreads each value to both neighbours instead.
+func TestMatchingHistogram(t *testing.T) {
+	var cover []uint8
+	for v := 32; v < 224; v += 4 {
+		for i := 0; i < 400; i++ {
+			cover = append(cover, uint8(v))
+		}
+	}
+	bits := newKeyStream([]byte("message bits"))
+	rng := newKeyStream([]byte("matching choices"))
+
+	var replaced, matched [256]int
+	for _, v := range cover {
+		bit := uint8(bits.Intn(2))
+		replaced[v&^1|bit]++
+		matched[matchValue(v, bit, 1, false, rng)]++
+	}
+
+	pairSkew := func(h [256]int) int {
+		skew := 0
+		for k := 0; k < 128; k++ {
+			skew += abs(h[2*k] - h[2*k+1])
+		}
+		return skew
+	}
+	if r, m := pairSkew(replaced), pairSkew(matched); m < 5*r {
+		t.Errorf("pair skew %d after matching, %d after replacement", m, r)
+	}
+	// Matching reaches the odd values below each cover value too
+	for v := 32; v < 224; v += 4 {
+		if matched[v-1] == 0 || matched[v+1] == 0 || replaced[v-1] != 0 {
+			t.Fatalf("around %d: matched %v, replaced %v", v, matched[v-1:v+2], replaced[v-1:v+2])
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Forward error correction for the embedded body, applied after encryption.
+// The data is dealt round-robin into as few Reed–Solomon codewords as fit
+// (byte i goes to codeword i mod c) and stays in order; the parity follows,
+// dealt the same way. So a run of damaged bytes is shared out between all
+// codewords instead of piling up in one, on top of the pixel order already
+// being scattered.
+
+// MaxFECParity bounds -fec. At 128 a codeword is half parity.
+const MaxFECParity = 128
+
+// fecCodewords is how many codewords n data bytes need at parity.
+func fecCodewords(n, parity int) int {
+	k := 255 - parity
+	return (n + k - 1) / k
+}
+
+// fecEncodedSize is the size of n data bytes once parity is added.
+func fecEncodedSize(n, parity int) int {
+	if parity == 0 {
+		return n
+	}
+	return n + fecCodewords(n, parity)*parity
+}
+
+// fecDataSize is the most data bytes that fit in size bytes at parity.
+func fecDataSize(size, parity int) int {
+	if parity == 0 {
+		return size
+	}
+	n := size * (255 - parity) / 255
+	for n > 0 && fecEncodedSize(n, parity) > size {
+		n--
+	}
+	for fecEncodedSize(n+1, parity) <= size {
+		n++
+	}
+	return n
+}
+
+// fecEncode appends the interleaved parity of data.
+func fecEncode(data []byte, parity int) []byte {
+	if parity == 0 {
+		return data
+	}
+	c := fecCodewords(len(data), parity)
+	out := make([]byte, len(data), fecEncodedSize(len(data), parity))
+	copy(out, data)
+	out = out[:cap(out)]
+
+	msg := make([]byte, 0, 255)
+	for i := 0; i < c; i++ {
+		msg = msg[:0]
+		for j := i; j < len(data); j += c {
+			msg = append(msg, data[j])
+		}
+		for j, p := range rsEncode(msg, parity) {
+			out[len(data)+j*c+i] = p
+		}
+	}
+	return out
+}
+
+// fecDecode corrects encoded, as laid out by fecEncode for n data bytes, and
+// returns the data and how many bytes were repaired. erased marks bytes
+// known to be lost, e.g. pixels cropped away.
+func fecDecode(encoded []byte, erased []bool, n, parity int) ([]byte, int, error) {
+	if parity == 0 {
+		return encoded[:n], 0, nil
+	}
+	if len(encoded) != fecEncodedSize(n, parity) || len(erased) != len(encoded) {
+		return nil, 0, errors.New("error correction data has the wrong size")
+	}
+
+	c := fecCodewords(n, parity)
+	data := make([]byte, n)
+	repaired := 0
+	for i := 0; i < c; i++ {
+		// Gather codeword i and where its bytes came from
+		var cw []byte
+		var from []int
+		for j := i; j < n; j += c {
+			cw, from = append(cw, encoded[j]), append(from, j)
+		}
+		for j := 0; j < parity; j++ {
+			at := n + j*c + i
+			cw, from = append(cw, encoded[at]), append(from, at)
+		}
+
+		var erasures []int
+		for pos, at := range from {
+			if erased[at] {
+				erasures = append(erasures, pos)
+			}
+		}
+		fixed, err := rsDecode(cw, parity, erasures)
+		if err != nil {
+			return nil, 0, fmt.Errorf("codeword %d of %d: %v", i+1, c, err)
+		}
+		repaired += fixed
+
+		for pos, at := range from[:len(from)-parity] {
+			data[at] = cw[pos]
+		}
+	}
+	return data, repaired, nil
+}
+
+// erasedBytes marks the bytes of bits that contain an unreadable bit (-1).
+func erasedBytes(bits []int) []bool {
+	erased := make([]bool, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit < 0 {
+			erased[i/8] = true
+		}
+	}
+	return erased
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestFECDataSize(t *testing.T) {
+	for _, parity := range []int{0, 1, 32, MaxFECParity} {
+		for size := 0; size < 2000; size += 37 {
+			n := fecDataSize(size, parity)
+			if fecEncodedSize(n, parity) > size || fecEncodedSize(n+1, parity) <= size {
+				t.Fatalf("fecDataSize(%d, %d) = %d is not the largest that fits", size, parity, n)
+			}
+		}
+	}
+}
+
+func TestFECRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	const parity = 32
+	data := make([]byte, 1000)
+	rng.Read(data)
+
+	encoded := fecEncode(data, parity)
+	if len(encoded) != fecEncodedSize(len(data), parity) {
+		t.Fatalf("encoded %d bytes, want %d", len(encoded), fecEncodedSize(len(data), parity))
+	}
+	if !bytes.Equal(encoded[:len(data)], data) {
+		t.Fatal("data is not kept in front of the parity")
+	}
+
+	// 1000 bytes at 32 parity are 5 codewords, so a run of 80 bad bytes
+	// is 16 errors in each: the most they correct
+	damaged := append([]byte(nil), encoded...)
+	for i := 100; i < 180; i++ {
+		damaged[i] ^= 0x5a
+	}
+	got, repaired, err := fecDecode(damaged, make([]bool, len(damaged)), len(data), parity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || repaired != 80 {
+		t.Errorf("errors: restored %v, repaired %d", bytes.Equal(got, data), repaired)
+	}
+
+	// Known-bad bytes cost half as much, so twice the run is fine when
+	// marked and too much when not
+	damaged = append([]byte(nil), encoded...)
+	erased := make([]bool, len(damaged))
+	for i := 500; i < 660; i++ {
+		damaged[i], erased[i] = ^damaged[i], true
+	}
+	if _, _, err := fecDecode(damaged, make([]bool, len(damaged)), len(data), parity); err == nil {
+		t.Error("decoded 32 unmarked errors per codeword")
+	}
+	got, _, err = fecDecode(damaged, erased, len(data), parity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("erasures: data not restored")
+	}
+}
+
+func TestErasedBytes(t *testing.T) {
+	bits := make([]int, 24)
+	bits[9] = -1
+	if got := erasedBytes(bits); got[0] || !got[1] || got[2] {
+		t.Errorf("erasedBytes = %v", got)
+	}
+}
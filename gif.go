@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"os"
+)
+
+// gifFormat writes the edited first frame back together with the rest of
+// the file's frames, loop count and timing.
+type gifFormat struct {
+	anim *gif.GIF
+}
+
+func (f *gifFormat) ext() string { return ".gif" }
+
+func (f *gifFormat) encodePaletted(w io.Writer, img *image.Paletted) error {
+	anim := *f.anim
+	anim.Image = append([]*image.Paletted{img}, f.anim.Image[1:]...)
+	return gif.EncodeAll(w, &anim)
+}
+
+// LoadGIF opens a GIF. Bits only go into its first frame, which has to cover
+// the whole image: a smaller frame would leave part of the picture out of
+// the carrier, and pixel positions would not be those of the image.
+func LoadGIF(filename string) (*PalettedImage, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	anim, err := gif.DecodeAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(anim.Image) == 0 {
+		return nil, errors.New("gif: no frames")
+	}
+	screen := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if frame := anim.Image[0].Bounds(); frame != screen {
+		return nil, fmt.Errorf("gif: first frame covers %v of a %dx%d image; only full first frames are supported", frame, screen.Dx(), screen.Dy())
+	}
+	return newPalettedImage(anim.Image[0], &gifFormat{anim: anim}), nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// The header region (the first SplitPoint pixels) is cut into HeaderSlots
+// equal windows. Each recipient gets one window, with its pixels ordered by
+// that recipient's HeaderLocationSeed. Every window is always written, unused
+// ones with random bits, so the image doesn't say how many recipients it has.
+const (
+	HeaderSlots = 8
+	SlotPixels  = SplitPoint / HeaderSlots
+)
+
+// MaxRecipients is how many keys (and passwords) one image can be hidden for.
+const MaxRecipients = HeaderSlots
+
+// SlotCopies is how many windows each recipient's slot goes into when there
+// are enough of them, so a damaged window doesn't lose the image. Every copy
+// is wrapped afresh (its own ephemeral key or salt, and nonce), so copies
+// look no more alike than any two slots.
+const SlotCopies = 2
+
+// slotCopies is how many copies of each of slotCount slots fit the header.
+func slotCopies(slotCount int) int {
+	return max(1, min(SlotCopies, HeaderSlots/slotCount))
+}
+
+// HeaderSlot is one filled slot ready to be written: the seed that orders its
+// pixels and the SlotSize bytes that go there.
+type HeaderSlot struct {
+	Seed []byte
+	Blob []byte
+}
+
+// SlotFor wraps the session for a recipient's public key.
+func (s *EncryptionSession) SlotFor(receiverPub *ecdh.PublicKey, metadata HeaderMetadata) (HeaderSlot, error) {
+	blob, err := s.WrapFor(receiverPub, metadata)
+	if err != nil {
+		return HeaderSlot{}, err
+	}
+	return HeaderSlot{Seed: HeaderLocationSeed(receiverPub), Blob: blob}, nil
+}
+
+// PasswordSlot wraps the session under a password.
+func (s *EncryptionSession) PasswordSlot(password []byte, params ScryptParams, metadata HeaderMetadata) (HeaderSlot, error) {
+	blob, err := s.WrapWithPassword(password, params, metadata)
+	if err != nil {
+		return HeaderSlot{}, err
+	}
+	return HeaderSlot{Seed: PasswordLocationSeed(), Blob: blob}, nil
+}
+
+// slotPixelsNeeded is how many pixels one slot occupies in mode.
+func slotPixelsNeeded(mode EmbeddingMode) int {
+	perPixel := mode.MaxBitsPerPixel()
+	return (SlotSize*8 + perPixel - 1) / perPixel
+}
+
+// slotMode is 1 LSB of RGB. A gray pixel only has one channel, and one bit
+// each would not fit a slot in its window, so gray images use two.
+func (img *EditableImage) slotMode() EmbeddingMode {
+	if img.pixelFormat().isGray() {
+		mode, _ := NewEmbeddingMode(2, false)
+		return mode.Grayscale()
+	}
+	return DefaultEmbeddingMode
+}
+
+func slotPoints(img *EditableImage, seed []byte, slot int) ([]image.Point, error) {
+	count := slotPixelsNeeded(img.slotMode())
+	return GeneratePointsInRange(img.Width(), img.Height(), seed, count, slot*SlotPixels, (slot+1)*SlotPixels)
+}
+
+// WriteSlot writes one slot into header window with slotMode, matching when
+// rng is set.
+func (img *EditableImage) WriteSlot(window int, seed []byte, bits []int, rng *keyStream) ([]image.Point, error) {
+	mode := img.slotMode()
+	mode.Matching = rng != nil
+
+	points, err := slotPoints(img, seed, window)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := WriteBitsAtPoints(img, bits, points, mode, rng); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func (img *EditableImage) ReadSlot(window int, seed []byte, nbits int) ([]int, error) {
+	points, err := slotPoints(img, seed, window)
+	if err != nil {
+		return nil, err
+	}
+	return ReadBitsAtPoints(img, points, img.slotMode())[:nbits], nil
+}
+
+// WriteHeader puts the slots in a random order and fills the remaining
+// windows with random bits. It returns all pixels it touched. A non-nil
+// matching stream writes the slots with LSB matching, like the body.
+func WriteHeader(c Carrier, slots []HeaderSlot, matching *keyStream) ([]image.Point, error) {
+	if len(slots) == 0 || len(slots) > HeaderSlots {
+		return nil, fmt.Errorf("need between 1 and %d recipients", MaxRecipients)
+	}
+
+	orderSeed := make([]byte, 32)
+	if _, err := rand.Read(orderSeed); err != nil {
+		return nil, err
+	}
+	order := newKeyStream(orderSeed).shuffledPrefix(HeaderSlots, HeaderSlots)
+
+	var touched []image.Point
+	for i, window := range order {
+		var slot HeaderSlot
+
+		if i < len(slots) {
+			slot = slots[i]
+		} else {
+			slot = HeaderSlot{Seed: make([]byte, 32), Blob: make([]byte, SlotSize)}
+			if _, err := rand.Read(slot.Seed); err != nil {
+				return nil, err
+			}
+			if _, err := rand.Read(slot.Blob); err != nil {
+				return nil, err
+			}
+		}
+
+		points, err := c.WriteSlot(window, slot.Seed, BytesToBits(slot.Blob), matching)
+		if err != nil {
+			return nil, err
+		}
+		touched = append(touched, points...)
+	}
+	return touched, nil
+}
+
+// readSlots reads every window with the given seed and returns the first one
+// open accepts. A damaged copy of a slot fails like any other, and the next
+// copy is tried.
+func readSlots(c Carrier, seed []byte, open func([]byte) (*HeaderMetadata, *EncryptionSession, error)) (*HeaderMetadata, *EncryptionSession, error) {
+	for window := 0; window < HeaderSlots; window++ {
+		bits, err := c.ReadSlot(window, seed, SlotSize*8)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		metadata, session, err := open(BitsToBytes(bits))
+		if errors.Is(err, ErrTampered) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return metadata, session, nil
+	}
+	return nil, nil, ErrTampered
+}
+
+// ReadHeader tries the private key against every slot and returns the first
+// one that opens.
+func ReadHeader(c Carrier, receiverPriv *ecdh.PrivateKey) (*HeaderMetadata, *EncryptionSession, error) {
+	return readSlots(c, HeaderLocationSeed(receiverPriv.PublicKey()), func(slot []byte) (*HeaderMetadata, *EncryptionSession, error) {
+		return ParseHeader(receiverPriv, slot)
+	})
+}
+
+// ReadPasswordHeader does the same with a password, at one scrypt run per
+// window.
+func ReadPasswordHeader(c Carrier, password []byte) (*HeaderMetadata, *EncryptionSession, error) {
+	return readSlots(c, PasswordLocationSeed(), func(slot []byte) (*HeaderMetadata, *EncryptionSession, error) {
+		return ParsePasswordSlot(password, slot)
+	})
+}
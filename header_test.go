@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestSlotCopies(t *testing.T) {
+	for slots, want := range map[int]int{1: 2, 4: 2, 5: 1, HeaderSlots: 1} {
+		if got := slotCopies(slots); got != want {
+			t.Errorf("slotCopies(%d) = %d, want %d", slots, got, want)
+		}
+	}
+}
+
+// Either copy of a slot opens the header on its own
+func TestSlotCopySurvivesDamage(t *testing.T) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := NewEncryptionSession(DefaultKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := &EditableImage{Img: noisyRGBA(120, 100, 15)}
+	var slots []HeaderSlot
+	for c := 0; c < slotCopies(1); c++ {
+		slot, err := session.SlotFor(priv.PublicKey(), testMetadata())
+		if err != nil {
+			t.Fatal(err)
+		}
+		slots = append(slots, slot)
+	}
+	if _, err := WriteHeader(img, slots, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	seed := HeaderLocationSeed(priv.PublicKey())
+	var windows []int
+	for window := 0; window < HeaderSlots; window++ {
+		bits, err := img.ReadSlot(window, seed, SlotSize*8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ParseHeader(priv, BitsToBytes(bits)); err == nil {
+			windows = append(windows, window)
+		}
+	}
+	if len(windows) != SlotCopies {
+		t.Fatalf("slot opens in windows %v, want %d of them", windows, SlotCopies)
+	}
+
+	noise := make([]int, SlotSize*8)
+	for i := range noise {
+		noise[i] = i % 3 % 2
+	}
+	for i, window := range windows {
+		if _, err := img.WriteSlot(window, seed, noise, nil); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := ReadHeader(img, priv)
+		if last := i == len(windows)-1; last != errors.Is(err, ErrTampered) {
+			t.Fatalf("%d of %d copies damaged: err = %v", i+1, len(windows), err)
+		}
+	}
+}
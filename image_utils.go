@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"image"
 	"image/draw"
 	"image/png"
+	"io"
 	"os"
 )
 
@@ -12,48 +14,137 @@ type Pixel struct {
 	R, G, B, A uint8
 }
 
-func (p *Pixel) set_LSB(bits [3]int) error {
+// channels returns the channels mode embeds in for this pixel.
+func (p *Pixel) channels(mode EmbeddingMode) []*uint8 {
 	channels := []*uint8{&p.R, &p.G, &p.B}
-	for i,bit := range bits {
-		if bit != 0 && bit != 1 {
-			return fmt.Errorf("Bit value must be 0 or 1")
+	if mode.Gray {
+		channels = channels[:1]
+	}
+	if mode.usesAlpha(*p) {
+		channels = append(channels, &p.A)
+	}
+	return channels
+}
+
+// channelDepth is how many low bits of channel mode uses.
+func (p *Pixel) channelDepth(channel *uint8, mode EmbeddingMode) int {
+	if channel == &p.A {
+		return alphaDepth
+	}
+	return mode.Depth
+}
+
+// setLowBits sets the low bits of each channel in turn to the next bits, most
+// significant first. Channels past the end of bits are left alone. Alpha is
+// always overwritten, even when matching: a carry could change whether the
+// pixel counts as opaque.
+func (p *Pixel) setLowBits(bits []int, mode EmbeddingMode, rng *keyStream) error {
+	pos := 0
+	for _, channel := range p.channels(mode) {
+		if pos >= len(bits) {
+			break
+		}
+		depth := p.channelDepth(channel, mode)
+		var value uint8
+		for j := 0; j < depth; j++ {
+			value <<= 1
+			if k := pos + j; k < len(bits) {
+				if bits[k] != 0 && bits[k] != 1 {
+					return fmt.Errorf("Bit value must be 0 or 1")
+				}
+				value |= uint8(bits[k])
+			} else {
+				// Short final channel: keep the cover's bit
+				value |= (*channel >> (depth - 1 - j)) & 1
+			}
 		}
-		if bit == 1 {
-			*channels[i] |= 1
+		if mode.Matching && channel != &p.A {
+			*channel = matchValue(*channel, value, depth, mode.Adaptive, rng)
 		} else {
-			*channels[i] &^= 1
+			mask := uint8(1)<<depth - 1
+			*channel = *channel&^mask | value
 		}
+		pos += depth
+	}
+	if mode.Gray {
+		// Keep the pixel gray so it reads the same as the file
+		p.G, p.B = p.R, p.R
 	}
 	return nil
 }
 
+// EditableImage keeps non-premultiplied pixels. With premultiplied RGBA the
+// colour bits of translucent pixels would not survive encoding.
 type EditableImage struct {
-	Img *image.RGBA
+	Img    *image.NRGBA
+	format pixelFormat // How Encode writes it back; truecolor PNG when nil
+}
+
+// pixelFormat writes an edited image back in the file format it came from.
+type pixelFormat interface {
+	ext() string
+	// hasAlpha reports whether the file stores an alpha channel at all
+	hasAlpha() bool
+	// isGray reports whether pixels have a single colour channel
+	isGray() bool
+	encode(w io.Writer, img *image.NRGBA) error
 }
 
-func load_png(filename string) (*EditableImage, error) {
-	file, err := os.Open(filename)
+// truecolorPNG is for PNGs we can't write back in their own colour model.
+// They come out as 8-bit RGB(A) and lose their ancillary chunks.
+type truecolorPNG struct{}
+
+func (truecolorPNG) ext() string    { return ".png" }
+func (truecolorPNG) hasAlpha() bool { return true }
+func (truecolorPNG) isGray() bool   { return false }
+
+func (truecolorPNG) encode(w io.Writer, img *image.NRGBA) error {
+	return png.Encode(w, img)
+}
+
+// load_png keeps the file's colour type, bit depth and chunks when it can,
+// see pngFormat, and falls back to truecolour otherwise. 8-bit palette
+// images come back as a PalettedImage.
+func load_png(filename string) (Carrier, error) {
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	src, err := png.Decode(file)
+	f, idat, err := parsePNG(data)
+	if err != nil {
+		return nil, err
+	}
+	if f.colorType == pngPaletted && f.depth == 8 {
+		img, err := f.palettedImage(idat)
+		if err != nil {
+			return nil, err
+		}
+		return newPalettedImage(img, f), nil
+	}
+	if f.preservable() {
+		if err := f.decode(idat); err != nil {
+			return nil, err
+		}
+		return &EditableImage{Img: f.layout.image(), format: f}, nil
+	}
+
+	src, err := png.Decode(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 
 	bounds := src.Bounds()
-	dst := image.NewRGBA(bounds)
+	dst := image.NewNRGBA(bounds)
 
 	draw.Draw(dst, bounds, src, bounds.Min, draw.Src)
 
-	return &EditableImage{Img: dst}, nil
+	return &EditableImage{Img: dst, format: truecolorPNG{}}, nil
 }
 
 func (e *EditableImage) GetPixel(x, y int) Pixel {
 	idx := e.Img.PixOffset(x, y)
-	
+
 	return Pixel{
 		R: e.Img.Pix[idx+0],
 		G: e.Img.Pix[idx+1],
@@ -64,7 +155,7 @@ func (e *EditableImage) GetPixel(x, y int) Pixel {
 
 func (e *EditableImage) SetPixel(x, y int, p Pixel) {
 	idx := e.Img.PixOffset(x, y)
-	
+
 	e.Img.Pix[idx+0] = p.R
 	e.Img.Pix[idx+1] = p.G
 	e.Img.Pix[idx+2] = p.B
@@ -79,50 +170,73 @@ func (e *EditableImage) Height() int {
 	return e.Img.Bounds().Dy()
 }
 
-func (e *EditableImage) Save(filename string) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	return png.Encode(file, e.Img)
+// Encode writes the image to w in its source format.
+func (e *EditableImage) Encode(w io.Writer) error {
+	return e.pixelFormat().encode(w, e.Img)
 }
 
-func WriteBitsAtPoints(img *EditableImage, bits []int, points []image.Point) error {
-	if len(points) * 3 < len(bits) {
-		return fmt.Errorf("not enough points to hold all bits")
+func (e *EditableImage) pixelFormat() pixelFormat {
+	if e.format == nil {
+		return truecolorPNG{}
 	}
+	return e.format
+}
 
-	pixelCounter := 0
-
-	for i := 0; i < len(bits); i += 3 {
-		pt := points[pixelCounter]
-		pixelCounter++
+// Save writes the image to filename atomically, see saveEncoded.
+func (e *EditableImage) Save(filename string) error {
+	return saveEncoded(filename, e)
+}
 
-		pixel := img.GetPixel(pt.X, pt.Y)
+// Clone returns a deep copy, e.g. for drawing a debug map on.
+func (e *EditableImage) Clone() *EditableImage {
+	dst := image.NewNRGBA(e.Img.Bounds())
+	copy(dst.Pix, e.Img.Pix)
+	return &EditableImage{Img: dst, format: e.format}
+}
 
-		var chunk [3]int
-		if i < len(bits)   { chunk[0] = bits[i] }
-		if i+1 < len(bits) { chunk[1] = bits[i+1] }
-		if i+2 < len(bits) { chunk[2] = bits[i+2] }
+// WriteBitsAtPoints writes bits into the points in order, BitsAt(pixel) bits
+// per pixel, and returns how many points it used. rng is only needed when
+// mode.Matching is set.
+func WriteBitsAtPoints(img *EditableImage, bits []int, points []image.Point, mode EmbeddingMode, rng *keyStream) (int, error) {
+	written := 0
+	for used, pt := range points {
+		if written >= len(bits) {
+			return used, nil
+		}
 
-		pixel.set_LSB(chunk) 
+		pixel := img.GetPixel(pt.X, pt.Y)
+		n := min(mode.BitsAt(pixel), len(bits)-written)
+		if err := pixel.setLowBits(bits[written:written+n], mode, rng); err != nil {
+			return used, err
+		}
 		img.SetPixel(pt.X, pt.Y, pixel)
+		written += n
 	}
-	return nil
+	if written < len(bits) {
+		return len(points), fmt.Errorf("not enough points to hold all bits")
+	}
+	return len(points), nil
 }
 
-func ReadBitsAtPoints(img *EditableImage, points []image.Point) []int {
+// ReadBitsAtPoints reads every bit mode puts in the points. Points outside
+// the image (cropped off since) read as -1 for each colour bit.
+func ReadBitsAtPoints(img *EditableImage, points []image.Point, mode EmbeddingMode) []int {
 	var bits []int
-	
+
 	for _, pt := range points {
+		if !pt.In(img.Img.Bounds()) {
+			for i := 0; i < mode.colourChannels()*mode.Depth; i++ {
+				bits = append(bits, -1)
+			}
+			continue
+		}
 		pixel := img.GetPixel(pt.X, pt.Y)
-		
-		// Extract 3 bits per pixel
-		bits = append(bits, int(pixel.R&1))
-		bits = append(bits, int(pixel.G&1))
-		bits = append(bits, int(pixel.B&1))
+
+		for _, channel := range pixel.channels(mode) {
+			for j := pixel.channelDepth(channel, mode) - 1; j >= 0; j-- {
+				bits = append(bits, int(*channel>>j&1))
+			}
+		}
 	}
 	return bits
 }
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A coefficient-level baseline JPEG reader and writer. image/jpeg only hands
+// out decoded pixels, and going through pixels would requantize everything.
+// Here the entropy-coded data is decoded into quantized DCT coefficients and
+// written back with the file's own Huffman tables; every other segment
+// (quantization tables, EXIF, ICC, ...) is copied through byte for byte.
+//
+// Embedding only ever flips the magnitude LSB of coefficients with |v| >= 2,
+// which keeps each coefficient's Huffman size category, so the original
+// tables can always code the result.
+
+const (
+	markerSOF0 = 0xC0
+	markerSOF1 = 0xC1
+	markerSOF2 = 0xC2
+	markerDHT  = 0xC4
+	markerRST0 = 0xD0
+	markerSOI  = 0xD8
+	markerEOI  = 0xD9
+	markerSOS  = 0xDA
+	markerDNL  = 0xDC
+	markerDRI  = 0xDD
+)
+
+type huffTable struct {
+	// Decoding, per code length: codes run from minCode to maxCode (-1 when
+	// there are none) and map to symbols[valPtr + code - minCode]
+	minCode, maxCode [17]int32
+	valPtr           [17]int
+	symbols          []byte
+
+	// Encoding
+	codes [256]uint16
+	sizes [256]uint8 // 0 when the symbol has no code
+}
+
+// newHuffTable builds the canonical code from the DHT counts and symbols.
+func newHuffTable(counts [16]byte, symbols []byte) (*huffTable, error) {
+	t := &huffTable{symbols: symbols}
+	code, k := int32(0), 0
+	for length := 1; length <= 16; length++ {
+		t.minCode[length], t.maxCode[length], t.valPtr[length] = code, -1, k
+		for i := 0; i < int(counts[length-1]); i++ {
+			if k >= len(symbols) {
+				return nil, errors.New("jpeg: short Huffman table")
+			}
+			sym := symbols[k]
+			t.codes[sym], t.sizes[sym] = uint16(code), uint8(length)
+			t.maxCode[length] = code
+			code++
+			k++
+		}
+		if code > 1<<length {
+			return nil, errors.New("jpeg: bad Huffman table")
+		}
+		code <<= 1
+	}
+	return t, nil
+}
+
+type jpegComponent struct {
+	id, h, v, tq     byte
+	blocksW, blocksH int     // Block grid padded to whole MCUs
+	codedW, codedH   int     // Blocks a non-interleaved scan codes
+	coeffs           []int32 // blocksW*blocksH blocks of 64, zigzag order
+	dcTable, acTable int
+	dcPred           int32
+}
+
+func (c *jpegComponent) block(bx, by int) []int32 {
+	i := (by*c.blocksW + bx) * 64
+	return c.coeffs[i : i+64]
+}
+
+type jpegScan struct {
+	header     []byte // SOS payload as read
+	components []*jpegComponent
+	dc, ac     [4]*huffTable
+	restart    int
+}
+
+// jpegSegment is one marker segment. Scans are kept as parsed headers and
+// re-encoded from the coefficients on write.
+type jpegSegment struct {
+	marker byte
+	data   []byte
+	scan   *jpegScan
+}
+
+// JPEGImage is a parsed baseline JPEG.
+type JPEGImage struct {
+	width, height int
+	components    []*jpegComponent
+	segments      []jpegSegment
+	trailer       []byte // Anything after EOI
+
+	cells []*int32 // Cached usableCoefficients
+}
+
+// LoadJPEG reads a baseline (sequential, Huffman coded) JPEG.
+func LoadJPEG(filename string) (*JPEGImage, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseJPEG(data)
+}
+
+func parseJPEG(data []byte) (*JPEGImage, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, errors.New("jpeg: missing SOI marker")
+	}
+
+	j := &JPEGImage{}
+	var dc, ac [4]*huffTable
+	restart := 0
+	pos := 2
+
+	for {
+		// Markers may be preceded by any number of 0xFF fill bytes
+		if pos >= len(data) || data[pos] != 0xFF {
+			return nil, errors.New("jpeg: expected a marker")
+		}
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		marker := data[pos]
+		pos++
+
+		if marker == markerEOI {
+			j.trailer = data[pos:]
+			break
+		}
+		if pos+2 > len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		length := int(data[pos])<<8 | int(data[pos+1])
+		if length < 2 || pos+length > len(data) {
+			return nil, errors.New("jpeg: bad segment length")
+		}
+		payload := data[pos+2 : pos+length]
+		pos += length
+
+		switch {
+		case marker == markerSOF0 || marker == markerSOF1:
+			if err := j.parseFrame(payload, len(data)-pos); err != nil {
+				return nil, err
+			}
+		case marker >= 0xC2 && marker <= 0xCF && marker != markerDHT && marker != 0xC8 && marker != 0xCC:
+			if marker == markerSOF2 {
+				return nil, errors.New("jpeg: progressive JPEG is not supported")
+			}
+			return nil, fmt.Errorf("jpeg: unsupported frame type 0x%02X", marker)
+		case marker == markerDHT:
+			if err := parseDHT(payload, &dc, &ac); err != nil {
+				return nil, err
+			}
+		case marker == markerDRI:
+			if len(payload) != 2 {
+				return nil, errors.New("jpeg: bad DRI segment")
+			}
+			restart = int(payload[0])<<8 | int(payload[1])
+		case marker == markerDNL:
+			return nil, errors.New("jpeg: DNL marker is not supported")
+		}
+
+		segment := jpegSegment{marker: marker, data: payload}
+		if marker == markerSOS {
+			scan, err := j.parseScanHeader(payload, dc, ac, restart)
+			if err != nil {
+				return nil, err
+			}
+			end := entropyEnd(data, pos)
+			if err := j.decodeScan(scan, data[pos:end]); err != nil {
+				return nil, err
+			}
+			segment.scan = scan
+			pos = end
+		}
+		j.segments = append(j.segments, segment)
+	}
+
+	if j.components == nil {
+		return nil, errors.New("jpeg: no frame header")
+	}
+	return j, nil
+}
+
+// parseFrame reads the frame header. remaining is how many bytes of the file
+// follow it, which bounds how many blocks the scans can code.
+func (j *JPEGImage) parseFrame(p []byte, remaining int) error {
+	if j.components != nil {
+		return errors.New("jpeg: more than one frame")
+	}
+	if len(p) < 6 {
+		return errors.New("jpeg: short frame header")
+	}
+	j.height = int(p[1])<<8 | int(p[2])
+	j.width = int(p[3])<<8 | int(p[4])
+	n := int(p[5])
+	if j.width == 0 || j.height == 0 {
+		return errors.New("jpeg: zero image size")
+	}
+	if n == 0 || len(p) != 6+3*n {
+		return errors.New("jpeg: bad frame header")
+	}
+
+	hmax, vmax := 1, 1
+	for i := 0; i < n; i++ {
+		c := &jpegComponent{id: p[6+3*i], h: p[7+3*i] >> 4, v: p[7+3*i] & 15, tq: p[8+3*i]}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 {
+			return errors.New("jpeg: bad sampling factors")
+		}
+		hmax, vmax = max(hmax, int(c.h)), max(vmax, int(c.v))
+		j.components = append(j.components, c)
+	}
+
+	mcusX := (j.width + 8*hmax - 1) / (8 * hmax)
+	mcusY := (j.height + 8*vmax - 1) / (8 * vmax)
+	// The header alone can ask for gigabytes of coefficients; same limit
+	// as PNG samples
+	var coeffs int64
+	for _, c := range j.components {
+		coeffs += int64(mcusX*int(c.h)) * int64(mcusY*int(c.v)) * 64
+	}
+	if coeffs*4 > 1<<31 {
+		return errors.New("jpeg: image too large")
+	}
+
+	// Every coded block takes at least two bits, a DC code and an EOB, so
+	// the rest of the file also bounds the size before anything is
+	// allocated. Padding blocks add at most a factor of 16 on top.
+	var coded int64
+	for _, c := range j.components {
+		c.blocksW, c.blocksH = mcusX*int(c.h), mcusY*int(c.v)
+		compW := (j.width*int(c.h) + hmax - 1) / hmax
+		compH := (j.height*int(c.v) + vmax - 1) / vmax
+		c.codedW, c.codedH = (compW+7)/8, (compH+7)/8
+		coded += int64(c.codedW) * int64(c.codedH)
+	}
+	if coded*2 > int64(remaining)*8 {
+		return errors.New("jpeg: frame is larger than the data that follows it")
+	}
+	for _, c := range j.components {
+		c.coeffs = make([]int32, c.blocksW*c.blocksH*64)
+	}
+	return nil
+}
+
+func parseDHT(p []byte, dc, ac *[4]*huffTable) error {
+	for len(p) > 0 {
+		if len(p) < 17 {
+			return errors.New("jpeg: short DHT segment")
+		}
+		class, id := p[0]>>4, p[0]&15
+		if class > 1 || id > 3 {
+			return errors.New("jpeg: bad DHT table id")
+		}
+		var counts [16]byte
+		copy(counts[:], p[1:17])
+		total := 0
+		for _, c := range counts {
+			total += int(c)
+		}
+		if len(p) < 17+total {
+			return errors.New("jpeg: short DHT segment")
+		}
+		table, err := newHuffTable(counts, p[17:17+total])
+		if err != nil {
+			return err
+		}
+		if class == 0 {
+			dc[id] = table
+		} else {
+			ac[id] = table
+		}
+		p = p[17+total:]
+	}
+	return nil
+}
+
+func (j *JPEGImage) parseScanHeader(p []byte, dc, ac [4]*huffTable, restart int) (*jpegScan, error) {
+	if j.components == nil {
+		return nil, errors.New("jpeg: scan before frame header")
+	}
+	if len(p) < 1 || len(p) != 1+2*int(p[0])+3 {
+		return nil, errors.New("jpeg: bad scan header")
+	}
+	n := int(p[0])
+	if n < 1 || n > 4 {
+		return nil, errors.New("jpeg: bad scan component count")
+	}
+	// Sequential scans always cover the whole spectrum in one go
+	if ss, se, a := p[1+2*n], p[2+2*n], p[3+2*n]; ss != 0 || se != 63 || a != 0 {
+		return nil, errors.New("jpeg: unsupported spectral selection")
+	}
+
+	scan := &jpegScan{header: p, dc: dc, ac: ac, restart: restart}
+	for i := 0; i < n; i++ {
+		id, tables := p[1+2*i], p[2+2*i]
+		var comp *jpegComponent
+		for _, c := range j.components {
+			if c.id == id {
+				comp = c
+			}
+		}
+		if comp == nil {
+			return nil, fmt.Errorf("jpeg: scan names unknown component %d", id)
+		}
+		comp.dcTable, comp.acTable = int(tables>>4), int(tables&15)
+		if comp.dcTable > 3 || comp.acTable > 3 || dc[comp.dcTable] == nil || ac[comp.acTable] == nil {
+			return nil, errors.New("jpeg: scan uses an undefined Huffman table")
+		}
+		scan.components = append(scan.components, comp)
+	}
+	return scan, nil
+}
+
+// entropyEnd finds the marker that ends the entropy-coded data starting at
+// pos. Stuffed zeros and restart markers belong to the data.
+func entropyEnd(data []byte, pos int) int {
+	for i := pos; i+1 < len(data); i++ {
+		if data[i] != 0xFF {
+			continue
+		}
+		next := data[i+1]
+		if next == 0x00 || (next >= markerRST0 && next <= markerRST0+7) {
+			i++
+			continue
+		}
+		if next == 0xFF {
+			continue
+		}
+		return i
+	}
+	return len(data)
+}
+
+// forEachBlock visits the scan's blocks in coding order: MCU by MCU for
+// interleaved scans, the component's own block raster otherwise. atMCU runs
+// before every MCU, which is where restart intervals are handled.
+func (j *JPEGImage) forEachBlock(scan *jpegScan, atMCU func(mcu int) error, fn func(c *jpegComponent, block []int32) error) error {
+	if len(scan.components) == 1 {
+		c := scan.components[0]
+		mcu := 0
+		for by := 0; by < c.codedH; by++ {
+			for bx := 0; bx < c.codedW; bx++ {
+				if err := atMCU(mcu); err != nil {
+					return err
+				}
+				if err := fn(c, c.block(bx, by)); err != nil {
+					return err
+				}
+				mcu++
+			}
+		}
+		return nil
+	}
+
+	first := scan.components[0]
+	mcusX, mcusY := first.blocksW/int(first.h), first.blocksH/int(first.v)
+	mcu := 0
+	for my := 0; my < mcusY; my++ {
+		for mx := 0; mx < mcusX; mx++ {
+			if err := atMCU(mcu); err != nil {
+				return err
+			}
+			for _, c := range scan.components {
+				for v := 0; v < int(c.v); v++ {
+					for h := 0; h < int(c.h); h++ {
+						if err := fn(c, c.block(mx*int(c.h)+h, my*int(c.v)+v)); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			mcu++
+		}
+	}
+	return nil
+}
+
+type bitReader struct {
+	data  []byte
+	pos   int
+	acc   uint32
+	nbits int
+}
+
+func (r *bitReader) bit() (uint32, error) {
+	if r.nbits == 0 {
+		if r.pos >= len(r.data) {
+			return 0, errors.New("jpeg: entropy data ends early")
+		}
+		b := r.data[r.pos]
+		r.pos++
+		if b == 0xFF {
+			if r.pos < len(r.data) && r.data[r.pos] == 0x00 {
+				r.pos++
+			} else {
+				return 0, errors.New("jpeg: unexpected marker in entropy data")
+			}
+		}
+		r.acc, r.nbits = uint32(b), 8
+	}
+	r.nbits--
+	return r.acc >> r.nbits & 1, nil
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) decode(t *huffTable) (byte, error) {
+	var code int32
+	for length := 1; length <= 16; length++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int32(b)
+		if code <= t.maxCode[length] {
+			return t.symbols[t.valPtr[length]+int(code-t.minCode[length])], nil
+		}
+	}
+	return 0, errors.New("jpeg: bad Huffman code")
+}
+
+// restart drops the partial byte and skips the RSTn marker.
+func (r *bitReader) restart() error {
+	r.nbits = 0
+	if r.pos+1 >= len(r.data) || r.data[r.pos] != 0xFF || r.data[r.pos+1] < markerRST0 || r.data[r.pos+1] > markerRST0+7 {
+		return errors.New("jpeg: missing restart marker")
+	}
+	r.pos += 2
+	return nil
+}
+
+// extend turns an s-bit JPEG magnitude code into a signed value.
+func extend(v uint32, s int) int32 {
+	if s == 0 {
+		return 0
+	}
+	if v < 1<<(s-1) {
+		return int32(v) - (1 << s) + 1
+	}
+	return int32(v)
+}
+
+func (j *JPEGImage) decodeScan(scan *jpegScan, data []byte) error {
+	r := &bitReader{data: data}
+	for _, c := range scan.components {
+		c.dcPred = 0
+	}
+
+	atMCU := func(mcu int) error {
+		if scan.restart == 0 || mcu == 0 || mcu%scan.restart != 0 {
+			return nil
+		}
+		for _, c := range scan.components {
+			c.dcPred = 0
+		}
+		return r.restart()
+	}
+
+	return j.forEachBlock(scan, atMCU, func(c *jpegComponent, block []int32) error {
+		s, err := r.decode(scan.dc[c.dcTable])
+		if err != nil {
+			return err
+		}
+		if s > 15 {
+			return errors.New("jpeg: bad DC size")
+		}
+		v, err := r.bits(int(s))
+		if err != nil {
+			return err
+		}
+		c.dcPred += extend(v, int(s))
+		block[0] = c.dcPred
+
+		for k := 1; k < 64; {
+			rs, err := r.decode(scan.ac[c.acTable])
+			if err != nil {
+				return err
+			}
+			run, size := int(rs>>4), int(rs&15)
+			if size == 0 {
+				if run != 15 {
+					break // EOB
+				}
+				k += 16
+				continue
+			}
+			k += run
+			if k > 63 {
+				return errors.New("jpeg: AC run past end of block")
+			}
+			v, err := r.bits(size)
+			if err != nil {
+				return err
+			}
+			block[k] = extend(v, size)
+			k++
+		}
+		return nil
+	})
+}
+
+type bitWriter struct {
+	buf   bytes.Buffer
+	acc   uint32
+	nbits int
+}
+
+func (w *bitWriter) write(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.acc = w.acc<<1 | v>>i&1
+		w.nbits++
+		if w.nbits == 8 {
+			b := byte(w.acc)
+			w.buf.WriteByte(b)
+			if b == 0xFF {
+				w.buf.WriteByte(0x00)
+			}
+			w.acc, w.nbits = 0, 0
+		}
+	}
+}
+
+// flush pads the last byte with ones, as the standard asks.
+func (w *bitWriter) flush() {
+	if w.nbits > 0 {
+		w.write(0xFF, 8-w.nbits)
+	}
+}
+
+func (w *bitWriter) symbol(t *huffTable, sym byte) error {
+	if t.sizes[sym] == 0 {
+		return fmt.Errorf("jpeg: Huffman table has no code for symbol 0x%02X", sym)
+	}
+	w.write(uint32(t.codes[sym]), int(t.sizes[sym]))
+	return nil
+}
+
+// magnitude returns the size category of v and its JPEG bit pattern.
+func magnitude(v int32) (int, uint32) {
+	a := v
+	if a < 0 {
+		a = -a
+	}
+	size := 0
+	for a>>size != 0 {
+		size++
+	}
+	if v < 0 {
+		return size, uint32(v+(1<<size)-1) & (1<<size - 1)
+	}
+	return size, uint32(v)
+}
+
+func (j *JPEGImage) encodeScan(scan *jpegScan) ([]byte, error) {
+	w := &bitWriter{}
+	for _, c := range scan.components {
+		c.dcPred = 0
+	}
+	rst := 0
+
+	atMCU := func(mcu int) error {
+		if scan.restart == 0 || mcu == 0 || mcu%scan.restart != 0 {
+			return nil
+		}
+		w.flush()
+		w.buf.Write([]byte{0xFF, byte(markerRST0 + rst)})
+		rst = (rst + 1) % 8
+		for _, c := range scan.components {
+			c.dcPred = 0
+		}
+		return nil
+	}
+
+	err := j.forEachBlock(scan, atMCU, func(c *jpegComponent, block []int32) error {
+		size, bits := magnitude(block[0] - c.dcPred)
+		c.dcPred = block[0]
+		if err := w.symbol(scan.dc[c.dcTable], byte(size)); err != nil {
+			return err
+		}
+		w.write(bits, size)
+
+		run := 0
+		for k := 1; k < 64; k++ {
+			if block[k] == 0 {
+				run++
+				continue
+			}
+			for ; run > 15; run -= 16 {
+				if err := w.symbol(scan.ac[c.acTable], 0xF0); err != nil {
+					return err
+				}
+			}
+			size, bits := magnitude(block[k])
+			if err := w.symbol(scan.ac[c.acTable], byte(run<<4|size)); err != nil {
+				return err
+			}
+			w.write(bits, size)
+			run = 0
+		}
+		if run > 0 {
+			return w.symbol(scan.ac[c.acTable], 0x00)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.flush()
+	return w.buf.Bytes(), nil
+}
+
+// Encode writes the JPEG back out with the current coefficients.
+func (j *JPEGImage) Encode(out io.Writer) error {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{0xFF, markerSOI})
+
+	for _, seg := range j.segments {
+		length := len(seg.data) + 2
+		buf.Write([]byte{0xFF, seg.marker, byte(length >> 8), byte(length)})
+		buf.Write(seg.data)
+
+		if seg.scan != nil {
+			scanData, err := j.encodeScan(seg.scan)
+			if err != nil {
+				return err
+			}
+			buf.Write(scanData)
+		}
+	}
+
+	buf.Write([]byte{0xFF, markerEOI})
+	buf.Write(j.trailer)
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+func (j *JPEGImage) Width() int {
+	return j.width
+}
+
+func (j *JPEGImage) Height() int {
+	return j.height
+}
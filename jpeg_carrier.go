@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"image"
+)
+
+// JPEG carrier: JSteg-style embedding in the magnitude LSB of quantized AC
+// coefficients. Coefficients of 0 and ±1 are skipped (changing them would
+// change the zero runs, and 1 -> 0 would make them vanish), and every other
+// value keeps |v| >= 2 after a flip, so sender and receiver always agree on
+// which coefficients carry bits. One bit per coefficient; the header windows
+// come first, then the body.
+
+// jpegSlotCells is the size of one header window: the slot plus a quarter,
+// so the slot's coefficients are still spread out within it. Coefficients
+// are scarce, so the margin is much smaller than for pixels.
+const jpegSlotCells = SlotSize * 8 * 5 / 4
+
+// jpegModes is the only way bits go into a JPEG.
+var jpegModes = []EmbeddingMode{{Name: "jsteg", Depth: 1, MatrixK: 1}}
+
+// usableCoefficients lists the AC coefficients that carry bits, component
+// by component and block by block.
+func (j *JPEGImage) usableCoefficients() []*int32 {
+	if j.cells == nil {
+		for _, c := range j.components {
+			for i := range c.coeffs {
+				if i%64 != 0 && (c.coeffs[i] >= 2 || c.coeffs[i] <= -2) {
+					j.cells = append(j.cells, &c.coeffs[i])
+				}
+			}
+		}
+	}
+	return j.cells
+}
+
+func getCoefficientBit(p *int32) int {
+	v := *p
+	if v < 0 {
+		v = -v
+	}
+	return int(v & 1)
+}
+
+func setCoefficientBit(p *int32, bit int) {
+	if *p < 0 {
+		*p = -(-*p&^1 | int32(bit))
+	} else {
+		*p = *p&^1 | int32(bit)
+	}
+}
+
+func (j *JPEGImage) Ext() string {
+	return ".jpg"
+}
+
+func (j *JPEGImage) Modes() []EmbeddingMode {
+	return jpegModes
+}
+
+func (j *JPEGImage) CheckMode(mode EmbeddingMode) (EmbeddingMode, error) {
+	if mode.Depth != 1 || mode.Alpha || mode.Matching || mode.Adaptive {
+		return mode, errors.New("JPEG carriers only support 1 bit per coefficient (-matrix is fine)")
+	}
+	mode.Name = jpegModes[0].Name
+	return mode, nil
+}
+
+func (j *JPEGImage) MaxBitsPerCell(mode EmbeddingMode) int {
+	return 1
+}
+
+func (j *JPEGImage) HeaderCells() int {
+	return min(HeaderSlots*jpegSlotCells, len(j.usableCoefficients()))
+}
+
+func (j *JPEGImage) BodyCells() int {
+	return len(j.usableCoefficients()) - j.HeaderCells()
+}
+
+func (j *JPEGImage) BodyCapacityBits(mode EmbeddingMode) int {
+	return j.BodyCells()
+}
+
+// slotCells picks nbits coefficients of header window in seed order.
+func (j *JPEGImage) slotCells(window int, seed []byte, nbits int) ([]*int32, error) {
+	cells := j.usableCoefficients()
+	if (window+1)*jpegSlotCells > len(cells) {
+		return nil, errors.New("JPEG has too few usable coefficients for a header")
+	}
+	if nbits > jpegSlotCells {
+		return nil, errors.New("header slot does not fit its window")
+	}
+
+	inWindow := cells[window*jpegSlotCells : (window+1)*jpegSlotCells]
+	picked := make([]*int32, nbits)
+	for i, offset := range newKeyStream(seed).shuffledPrefix(jpegSlotCells, nbits) {
+		picked[i] = inWindow[offset]
+	}
+	return picked, nil
+}
+
+// WriteSlot ignores rng: JSteg has no matching variant.
+func (j *JPEGImage) WriteSlot(window int, seed []byte, bits []int, rng *keyStream) ([]image.Point, error) {
+	cells, err := j.slotCells(window, seed, len(bits))
+	if err != nil {
+		return nil, err
+	}
+	for i, cell := range cells {
+		setCoefficientBit(cell, bits[i])
+	}
+	return nil, nil
+}
+
+func (j *JPEGImage) ReadSlot(window int, seed []byte, nbits int) ([]int, error) {
+	cells, err := j.slotCells(window, seed, nbits)
+	if err != nil {
+		return nil, err
+	}
+	bits := make([]int, nbits)
+	for i, cell := range cells {
+		bits[i] = getCoefficientBit(cell)
+	}
+	return bits, nil
+}
+
+// bodyCells picks count body coefficients in seed order.
+func (j *JPEGImage) bodyCells(seed []byte, count int, mode EmbeddingMode) ([]*int32, error) {
+	cells := j.usableCoefficients()[j.HeaderCells():]
+	offsets, err := bodyOffsets(seed, count, len(cells), mode)
+	if err != nil {
+		return nil, err
+	}
+	picked := make([]*int32, count)
+	for i, offset := range offsets {
+		picked[i] = cells[offset]
+	}
+	return picked, nil
+}
+
+func (j *JPEGImage) EmbedBody(seed []byte, bits []int, mode EmbeddingMode, rng *keyStream) ([]image.Point, error) {
+	cells, err := j.bodyCells(seed, matrixCoverBits(len(bits), mode.MatrixK), mode)
+	if err != nil {
+		return nil, err
+	}
+
+	cover := make([]int, len(cells))
+	for i, cell := range cells {
+		cover[i] = getCoefficientBit(cell)
+	}
+	for i, bit := range matrixEmbed(cover, bits, mode.MatrixK) {
+		setCoefficientBit(cells[i], bit)
+	}
+	return nil, nil
+}
+
+func (j *JPEGImage) ExtractBody(seed []byte, nbits int, mode EmbeddingMode) ([]int, error) {
+	cells, err := j.bodyCells(seed, matrixCoverBits(nbits, mode.MatrixK), mode)
+	if err != nil {
+		return nil, errors.New("recovered body size does not fit this image")
+	}
+
+	stego := make([]int, len(cells))
+	for i, cell := range cells {
+		stego[i] = getCoefficientBit(cell)
+	}
+	return matrixExtract(stego, nbits, mode.MatrixK), nil
+}
+
+// Save writes the JPEG atomically, see saveEncoded.
+func (j *JPEGImage) Save(filename string) error {
+	return saveEncoded(filename, j)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, noisyRGBA(67, 45, 7), &jpeg.Options{Quality: 85}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Re-encoding untouched coefficients has to give them back exactly, and the
+// result has to stay a JPEG the standard decoder reads.
+func TestJPEGCodecRoundTrip(t *testing.T) {
+	data := testJPEG(t)
+	j, err := parseJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Width() != 67 || j.Height() != 45 || len(j.components) != 3 {
+		t.Fatalf("parsed %dx%d with %d components", j.Width(), j.Height(), len(j.components))
+	}
+
+	// Change some coefficients, as embedding does
+	cells := j.usableCoefficients()
+	if len(cells) == 0 {
+		t.Fatal("no usable coefficients")
+	}
+	for i := 0; i < len(cells); i += 7 {
+		*cells[i] ^= 1
+	}
+
+	var buf bytes.Buffer
+	if err := j.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	again, err := parseJPEG(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range j.components {
+		if !slices.Equal(c.coeffs, again.components[i].coeffs) {
+			t.Errorf("component %d coefficients changed in the round trip", i)
+		}
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Errorf("image/jpeg can't read the output: %v", err)
+	}
+}
+
+func TestJPEGRejectsBadInput(t *testing.T) {
+	data := testJPEG(t)
+	if _, err := parseJPEG(data[:len(data)/2]); err == nil {
+		t.Error("truncated JPEG accepted")
+	}
+	if _, err := parseJPEG([]byte("not a jpeg")); err == nil {
+		t.Error("non-JPEG accepted")
+	}
+
+	// A 65535x65535 frame asks for 16 GiB of coefficients
+	j := &JPEGImage{}
+	if err := j.parseFrame([]byte{8, 0xff, 0xff, 0xff, 0xff, 1, 1, 0x11, 0}, 1<<30); err == nil {
+		t.Error("huge frame accepted")
+	}
+}
+
+// A frame header under the 2 GiB limit still can't allocate more than the
+// file could code
+func TestJPEGFrameBoundedByData(t *testing.T) {
+	data := []byte{0xff, markerSOI, 0xff, markerSOF0, 0, 11, 8, 0x3e, 0x80, 0x3e, 0x80, 1, 1, 0x11, 0}
+	data = append(data, make([]byte, 200)...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := parseJPEG(data); err == nil {
+		t.Fatal("16000x16000 frame in a 215-byte file accepted")
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("allocated %d bytes for a 215-byte file", alloc)
+	}
+
+	// The bound leaves real files alone
+	if _, err := parseJPEG(testJPEG(t)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJPEGHideReveal(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover, out := filepath.Join(dir, "cover.jpg"), filepath.Join(dir, "out.jpg")
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, noisyRGBA(240, 200, 13), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, cover, buf.Bytes())
+
+	for _, extra := range [][]string{nil, {"-matrix"}} {
+		mustRun(t, nil, append([]string{"hide", "-k", pub, "-i", cover, "-o", out, "-t", "in the coefficients"}, extra...)...)
+		if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "in the coefficients") {
+			t.Errorf("%v: reveal printed:\n%s", extra, got)
+		}
+	}
+	data, _ := os.ReadFile(out)
+	if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("image/jpeg can't read the stego image: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// RFC 5869 appendix A.1.
+func TestHKDFKnownAnswer(t *testing.T) {
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt := unhex(t, "000102030405060708090a0b0c")
+	info := unhex(t, "f0f1f2f3f4f5f6f7f8f9")
+	wantPRK := unhex(t, "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5")
+	wantOKM := unhex(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865")
+
+	prk := hkdfExtract(salt, ikm)
+	if !bytes.Equal(prk, wantPRK) {
+		t.Errorf("PRK = %x, want %x", prk, wantPRK)
+	}
+	if okm := hkdfExpand(prk, string(info), 42); !bytes.Equal(okm, wantOKM) {
+		t.Errorf("OKM = %x, want %x", okm, wantOKM)
+	}
+}
+
+// Every key a session derives is independent of the others, and the body
+// key sizes don't share prefixes.
+func TestSessionKeysDistinct(t *testing.T) {
+	contentKey := bytes.Repeat([]byte{7}, ContentKeySize)
+	seen := make(map[string]string)
+	add := func(name string, key []byte) {
+		if other, ok := seen[string(key[:16])]; ok {
+			t.Errorf("%s and %s share their first 16 bytes", name, other)
+		}
+		seen[string(key[:16])] = name
+	}
+
+	for _, size := range []int{16, 24, 32} {
+		s := sessionFromContentKey(contentKey, size)
+		key, macKey := s.bodyKeys()
+		if len(key) != size {
+			t.Errorf("AES-%d body key is %d bytes", size*8, len(key))
+		}
+		add(fmt.Sprintf("AES-%d body key", size*8), key)
+		if size == 32 {
+			add("body MAC key", macKey)
+			add("pixel seed", s.PixelSeed())
+			add("decoy content key", s.DecoySession().ContentKey)
+		}
+	}
+}
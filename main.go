@@ -1,20 +1,27 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
 	"crypto/ecdh"
-	"encoding/binary"
+	"crypto/ecdsa"
+	"errors"
 	"flag"
 	"fmt"
+	"image"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const MasterSeed int64 = 1234567890
 const SplitPoint = 5000
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Expected 'hide' or 'reveal' subcommand")
+		fmt.Println("Expected 'hide', 'reveal', 'keygen', 'capacity' or 'analyze' subcommand")
 		os.Exit(1)
 	}
 
@@ -23,211 +30,843 @@ func main() {
 		handleHide(os.Args[2:])
 	case "reveal":
 		handleReveal(os.Args[2:])
+	case "keygen":
+		handleKeygen(os.Args[2:])
+	case "capacity":
+		handleCapacity(os.Args[2:])
+	case "analyze":
+		handleAnalyze(os.Args[2:])
 	default:
-		fmt.Println("Expected 'hide' or 'reveal' subcommand")
+		fmt.Println("Expected 'hide', 'reveal', 'keygen', 'capacity' or 'analyze' subcommand")
 		os.Exit(1)
 	}
 }
 
 func handleHide(args []string) {
 	cmd := flag.NewFlagSet("hide", flag.ExitOnError)
-	key := cmd.String("k", "", "Path to Receiver's Public Key")
-	textArg := cmd.String("t", "", "Text to hide")        // Raw text option
-	textFile := cmd.String("tf", "", "Path to text file") // File option
-	imgPath := cmd.String("i", "", "Path to input image")
+	var keyPaths, imgPaths stringList
+	cmd.Var(&keyPaths, "k", "Path to a Receiver's Public Key (repeat for several recipients)")
+	textArg := cmd.String("t", "", "Text to hide")                      // Raw text option
+	textFile := cmd.String("tf", "", "Path to file to hide (any type)") // File option
+	cmd.Var(&imgPaths, "i", "Path to input image (repeat to split the payload across several)")
+	aesBits := cmd.Int("aes", DefaultKeySize*8, "Body AES key size in bits: 128, 192 or 256")
+	outPath := cmd.String("o", "", "Path to output image, in the input's format (default output plus the input's extension; '-' for stdout). With several -i, a prefix: output-1.png and so on")
+	debugMap := cmd.String("debug-map", "", "Also write a map of the modified pixels to this path (one -i only)")
+	signPath := cmd.String("sign", "", "Sign with this sender private key")
+	usePassword := cmd.Bool("password", false, "Also let a password open the image (prompted, or from $"+PasswordEnv+")")
+	depth := cmd.Int("depth", 1, "Low bits per channel to embed in, 1 to 4 (of the low byte for 16-bit PNGs)")
+	useAlpha := cmd.Bool("alpha", false, "Also embed in the alpha channel of opaque pixels")
+	matching := cmd.Bool("matching", false, "Use LSB matching (±1) instead of LSB replacement")
+	useMatrix := cmd.Bool("matrix", false, "Use Hamming matrix embedding to change fewer pixels")
+	adaptive := cmd.Bool("adaptive", false, "Prefer textured pixels over flat areas")
+	kdfCost := cmd.Int("kdf-cost", int(DefaultScryptParams.LogN), "scrypt cost for -password as log2(N), 15 (32 MiB) to 18 (256 MiB, slower and stronger); recorded in the image")
+	fecParity := cmd.Int("fec", 0, fmt.Sprintf("Reed–Solomon parity bytes per 255-byte codeword, 0 (off) to %d; each two fix one damaged byte", MaxFECParity))
+	spare := cmd.Int("spare", 0, "With several -i, how many of the images reveal can do without")
+	var decoyKeyPaths stringList
+	cmd.Var(&decoyKeyPaths, "decoy-k", "Also hide a decoy for this public key, which reveals only the decoy (repeatable)")
+	decoyText := cmd.String("decoy-t", "", "Decoy text")
+	decoyFile := cmd.String("decoy-tf", "", "Path to decoy file")
 
 	cmd.Parse(args)
-	keyPath := *key
 
-	if *imgPath == "" || keyPath == "" {
-		fmt.Println("Error: -i and -k are required.")
+	// Keep stdout clean for the image when it is the destination
+	status := os.Stdout
+	if *outPath == "-" {
+		status = os.Stderr
+	}
+
+	if len(imgPaths) == 0 || (len(keyPaths) == 0 && !*usePassword) {
+		fmt.Fprintln(status, "Error: -i and -k (or -password) are required.")
 		cmd.PrintDefaults()
-		return
+		os.Exit(1)
+	}
+
+	shardCount := len(imgPaths)
+	if shardCount > MaxShards {
+		fmt.Fprintf(status, "Error: at most %d images (-i) per payload\n", MaxShards)
+		os.Exit(1)
+	}
+	if *spare < 0 || *spare >= shardCount {
+		fmt.Fprintln(status, "Error: -spare must be less than the number of images (-i)")
+		os.Exit(1)
+	}
+	shardsNeeded := shardCount - *spare
+	if shardCount > 1 && *outPath == "-" {
+		fmt.Fprintln(status, "Error: -o - only works with one image")
+		os.Exit(1)
+	}
+	if shardCount > 1 && *debugMap != "" {
+		fmt.Fprintln(status, "Error: -debug-map only works with one image")
+		os.Exit(1)
+	}
+
+	if (len(decoyKeyPaths) > 0) != (*decoyText != "" || *decoyFile != "") {
+		fmt.Fprintln(status, "Error: a decoy needs both -decoy-k and -decoy-t or -decoy-tf")
+		os.Exit(1)
+	}
+	if len(decoyKeyPaths) > 0 && shardCount > 1 {
+		fmt.Fprintln(status, "Error: a decoy only works with one image")
+		os.Exit(1)
+	}
+
+	slotCount := len(keyPaths) + len(decoyKeyPaths)
+	if *usePassword {
+		slotCount++
+	}
+	if slotCount > MaxRecipients {
+		fmt.Fprintf(status, "Error: at most %d recipients (-k and -password) per image\n", MaxRecipients)
+		os.Exit(1)
+	}
+	copies := slotCopies(slotCount)
+
+	scryptParams, err := PasswordParams(uint8(*kdfCost))
+	if *kdfCost < 0 || *kdfCost > 255 || err != nil {
+		fmt.Fprintf(status, "Error: -kdf-cost must be one of %v\n", PasswordCosts)
+		os.Exit(1)
 	}
 
 	if *textArg == "" && *textFile == "" {
-		fmt.Println("Error: You must provide text via -t OR a file via -tf")
+		fmt.Fprintln(status, "Error: You must provide text via -t OR a file via -tf")
 		cmd.PrintDefaults()
-		return
+		os.Exit(1)
+	}
+
+	if *aesBits%8 != 0 || !validKeySize(*aesBits/8) {
+		fmt.Fprintln(status, "Error: -aes must be 128, 192 or 256")
+		os.Exit(1)
+	}
+
+	if *fecParity < 0 || *fecParity > MaxFECParity {
+		fmt.Fprintf(status, "Error: -fec must be between 0 and %d\n", MaxFECParity)
+		os.Exit(1)
+	}
+
+	baseMode, err := NewEmbeddingMode(*depth, *useAlpha)
+	if err != nil {
+		fmt.Fprintln(status, "Error:", err)
+		os.Exit(1)
 	}
+	baseMode.Matching = *matching
+	baseMode.Adaptive = *adaptive
 
-	var textData []byte
-	var err error
+	var payload *Payload
 
 	if *textFile != "" {
-		textData, err = os.ReadFile(*textFile)
+		payload, err = NewFilePayload(*textFile)
 		if err != nil {
-			fmt.Println("Error reading text file:", err)
-			return
+			fmt.Fprintln(status, "Error reading file:", err)
+			os.Exit(1)
 		}
 	} else {
-		textData = []byte(*textArg)
+		payload = NewTextPayload(*textArg)
 	}
 
-	img, err := load_png(*imgPath)
+	textData, err := payload.MarshalBinary()
 	if err != nil {
-		fmt.Println("Image Load Error:", err)
-		return
+		fmt.Fprintln(status, "Error packing payload:", err)
+		os.Exit(1)
+	}
+	if len(textData) < len(payload.Data) {
+		fmt.Fprintf(status, "Compressed %d bytes of data into a %d byte payload\n", len(payload.Data), len(textData))
 	}
 
-	keyObj, kType, err := LoadECCKey(keyPath)
-	if err != nil {
-		fmt.Println("Key Error:", err)
-		return
+	var decoyData []byte
+	if len(decoyKeyPaths) > 0 {
+		decoyPayload := NewTextPayload(*decoyText)
+		if *decoyFile != "" {
+			decoyPayload, err = NewFilePayload(*decoyFile)
+			if err != nil {
+				fmt.Fprintln(status, "Error reading decoy file:", err)
+				os.Exit(1)
+			}
+		}
+		if decoyData, err = decoyPayload.MarshalBinary(); err != nil {
+			fmt.Fprintln(status, "Error packing decoy:", err)
+			os.Exit(1)
+		}
 	}
-	if kType != KeyTypePublic {
-		fmt.Println("Error: To hide, you need the RECEIVER'S PUBLIC KEY.")
-		return
+
+	carriers := make([]Carrier, shardCount)
+	modes := make([]EmbeddingMode, shardCount)
+	outPaths := make([]string, shardCount)
+	for i, imgPath := range imgPaths {
+		img, err := LoadCarrier(imgPath)
+		if err != nil {
+			fmt.Fprintln(status, "Image Load Error:", err)
+			os.Exit(1)
+		}
+		if modes[i], err = img.CheckMode(baseMode); err != nil {
+			fmt.Fprintf(status, "Error: %s: %v\n", imgPath, err)
+			os.Exit(1)
+		}
+		if _, ok := img.(*JPEGImage); *debugMap != "" && ok {
+			fmt.Fprintln(status, "Error: -debug-map needs a pixel image, not a JPEG")
+			os.Exit(1)
+		}
+		carriers[i] = img
+
+		switch {
+		case shardCount > 1:
+			prefix := cmp.Or(*outPath, "output")
+			outPaths[i] = shardPath(prefix, i, img.Ext())
+		case *outPath == "":
+			outPaths[i] = "output" + img.Ext()
+		default:
+			outPaths[i] = *outPath
+		}
 	}
-	pubKey := keyObj.(*ecdh.PublicKey)
 
-	session, err := NewEncryptionSession(pubKey)
-	if err != nil {
-		fmt.Println("Key Generation Failed:", err)
-		return
+	var signKey *ecdsa.PrivateKey
+	if *signPath != "" {
+		keyObj, kType, err := LoadECDSAKey(*signPath)
+		if err != nil {
+			fmt.Fprintln(status, "Signing Key Error:", err)
+			os.Exit(1)
+		}
+		if kType != KeyTypePrivate {
+			fmt.Fprintln(status, "Error: To sign, you need YOUR PRIVATE KEY.")
+			os.Exit(1)
+		}
+		signKey = keyObj.(*ecdsa.PrivateKey)
 	}
 
-	fmt.Println("Encrypting Body with derived AES key...")
-	encryptedBodyBytes, err := encryptBits(textData, session.SharedKey)
-	if err != nil {
-		fmt.Println("Body Encryption Failed:", err)
-		return
+	opts := CapacityOptions{Signed: signKey != nil, Parity: *fecParity, Decoy: decoyData, Needed: shardsNeeded}
+	maxSize := payloadRoom(carriers, modes, opts)
+	if len(textData) > maxSize {
+		stored, maxData := len(textData)-payload.Overhead(), max(maxSize-payload.Overhead(), 0)
+		if shardCount > 1 {
+			fmt.Fprintf(status, "Error: Payload data is %d bytes but these images hold at most %d (see 'imgcrypt capacity')\n", stored, maxData)
+		} else {
+			fmt.Fprintf(status, "Error: Payload data is %d bytes but this image holds at most %d (see 'imgcrypt capacity')\n", stored, maxData)
+		}
+		os.Exit(1)
 	}
 
-	payloadBuf := new(bytes.Buffer)
-	binary.Write(payloadBuf, binary.LittleEndian, int32(len(encryptedBodyBytes)))
+	var recipients []*ecdh.PublicKey
+	for _, keyPath := range keyPaths {
+		keyObj, kType, err := LoadECCKey(keyPath)
+		if err != nil {
+			fmt.Fprintln(status, "Key Error:", err)
+			os.Exit(1)
+		}
+		if kType != KeyTypePublic {
+			fmt.Fprintln(status, "Error: To hide, you need the RECEIVER'S PUBLIC KEY.")
+			os.Exit(1)
+		}
+		recipients = append(recipients, keyObj.(*ecdh.PublicKey))
+	}
+	var decoyRecipients []*ecdh.PublicKey
+	for _, keyPath := range decoyKeyPaths {
+		keyObj, kType, err := LoadECCKey(keyPath)
+		if err != nil {
+			fmt.Fprintln(status, "Decoy Key Error:", err)
+			os.Exit(1)
+		}
+		if kType != KeyTypePublic {
+			fmt.Fprintln(status, "Error: A decoy needs the RECEIVER'S PUBLIC KEY.")
+			os.Exit(1)
+		}
+		decoyRecipients = append(decoyRecipients, keyObj.(*ecdh.PublicKey))
+	}
+	// A key in both sets would open the real body and the decoy alike,
+	// whichever slot it found first
+	for _, decoyPub := range decoyRecipients {
+		if slices.ContainsFunc(recipients, func(pub *ecdh.PublicKey) bool { return pub.Equal(decoyPub) }) {
+			fmt.Fprintln(status, "Error: a key can't be both a -k and a -decoy-k recipient")
+			os.Exit(1)
+		}
+	}
 
-	fmt.Println("Building Header...")
-	encryptedHeaderBytes, err := session.BuildHeader(payloadBuf.Bytes())
-	if err != nil {
-		fmt.Println("Header Build Failed:", err)
-		return
+	var password []byte
+	if *usePassword {
+		password, err = ReadPassword(true)
+		if err != nil {
+			fmt.Fprintln(status, "Password Error:", err)
+			os.Exit(1)
+		}
 	}
 
-	encryptedHeaderBits := BytesToBits(encryptedHeaderBytes)
-	headerPixelsNeeded := (len(encryptedHeaderBits) + 2) / 3
+	session, err := NewEncryptionSession(*aesBits / 8)
+	if err != nil {
+		fmt.Fprintln(status, "Key Generation Failed:", err)
+		os.Exit(1)
+	}
+	setID, err := newShardSetID()
+	if err != nil {
+		fmt.Fprintln(status, "Key Generation Failed:", err)
+		os.Exit(1)
+	}
 
-	headerPoints, err := GeneratePointsInRange(img.Width(), img.Height(), MasterSeed, headerPixelsNeeded, 0, SplitPoint)
+	fmt.Fprintf(status, "Encrypting Body with AES-%d content key...\n", session.KeySize*8)
+	encryptedBodyBytes, err := session.EncryptBody(textData)
 	if err != nil {
-		fmt.Println("Header Point Generation Error:", err)
-		return
+		fmt.Fprintln(status, "Body Encryption Failed:", err)
+		os.Exit(1)
 	}
 
-	fmt.Printf("Writing %d encrypted header bits...\n", len(encryptedHeaderBits))
-	WriteBitsAtPoints(img, encryptedHeaderBits, headerPoints)
+	shards := splitShards(encryptedBodyBytes, shardCount, shardsNeeded)
+	if shardCount > 1 {
+		fmt.Fprintf(status, "Split into %d shards of %d bytes, any %d of which reveal it\n", shardCount, len(shards[0]), shardsNeeded)
+	}
 
-	bodyBits := BytesToBits(encryptedBodyBytes)
+	var matchingStream *keyStream
+	if baseMode.Matching {
+		matchingStream = session.MatchingStream()
+	}
 
-	sessionSeed := passwordToSeed(string(session.SharedKey))
+	for i, img := range carriers {
+		mode := modes[i]
+		if shardCount > 1 {
+			fmt.Fprintf(status, "Shard %d of %d: %s\n", i+1, shardCount, imgPaths[i])
+		}
 
-	totalPixels := img.Width() * img.Height()
-	availablePixels := totalPixels - SplitPoint
-	bodyPixelsNeeded := (len(bodyBits) + 2) / 3
+		// Recorded so reveal still finds the body pixels after a crop
+		mode.Cells = img.BodyCells()
 
-	fmt.Printf("Pixels Needed: %d, Pixels Available: %d\n", bodyPixelsNeeded, availablePixels)
-	if bodyPixelsNeeded > availablePixels {
-		fmt.Println("Error: Image is too small to hold this data!")
-		return
-	}
+		embeddedSize := len(shards[i])
+		if signKey != nil {
+			embeddedSize += SignatureSize
+		}
+		embeddedBits := fecEncodedSize(embeddedSize, *fecParity) * 8
+		capacity := img.BodyCapacityBits(mode)
+
+		// The decoy takes its cells first, leaving the real body at least
+		// room for plain embedding
+		var decoy *decoyBody
+		if decoyData != nil {
+			decoyMode := mode
+			if *useMatrix {
+				decoyBits := fecEncodedSize(decoySize(decoyData, signKey != nil), *fecParity) * 8
+				decoyMode.MatrixK = chooseMatrixK(decoyBits, capacity-embeddedBits)
+			}
+			decoy, err = newDecoyBody(session, decoyData, decoyRecipients, copies, decoyMode, *fecParity, signKey)
+			if err != nil {
+				fmt.Fprintln(status, "Decoy Build Failed:", err)
+				os.Exit(1)
+			}
+			mode.Avoid = decoy.layout()
+			perCell := img.MaxBitsPerCell(mode)
+			capacity -= (mode.Avoid.CoverBits + perCell - 1) / perCell * perCell
+		}
 
-	bodyPoints, err := GeneratePointsInRange(img.Width(), img.Height(), sessionSeed, bodyPixelsNeeded, SplitPoint, totalPixels)
-	if err != nil {
-		fmt.Println("Body Point Generation Error:", err)
-		return
-	}
+		if *useMatrix {
+			mode.MatrixK = chooseMatrixK(embeddedBits, capacity)
+			fmt.Fprintf(status, "Matrix embedding: %d bits per %d LSBs\n", mode.MatrixK, 1<<mode.MatrixK-1)
+		}
+
+		metadata := HeaderMetadata{
+			Version:      HeaderVersion,
+			BodySize:     int32(len(encryptedBodyBytes)),
+			KeySize:      uint8(session.KeySize),
+			Parity:       uint8(*fecParity),
+			SetID:        setID,
+			ShardIndex:   uint8(i),
+			ShardCount:   uint8(shardCount),
+			ShardsNeeded: uint8(shardsNeeded),
+		}
+		metadata.SetEmbeddingMode(mode)
+		if signKey != nil {
+			metadata.Flags |= HeaderFlagSigned
+		}
+		if decoy != nil {
+			metadata.DecoyBits = int32(mode.Avoid.CoverBits)
+		}
+
+		embeddedBody := shards[i]
+		if signKey != nil {
+			fmt.Fprintln(status, "Signing header and body...")
+			plainMetadata, _ := metadata.MarshalBinary()
+			sig, err := SignEmbedded(signKey, plainMetadata, shards[i])
+			if err != nil {
+				fmt.Fprintln(status, "Signing Failed:", err)
+				os.Exit(1)
+			}
+			embeddedBody = append(embeddedBody, sig...)
+		}
+
+		var slots []HeaderSlot
+		for _, recipient := range recipients {
+			for c := 0; c < copies; c++ {
+				slot, err := session.SlotFor(recipient, metadata)
+				if err != nil {
+					fmt.Fprintln(status, "Header Build Failed:", err)
+					os.Exit(1)
+				}
+				slots = append(slots, slot)
+			}
+		}
+		if password != nil {
+			fmt.Fprintf(status, "Deriving password key (scrypt N=2^%d)...\n", scryptParams.LogN)
+			for c := 0; c < copies; c++ {
+				slot, err := session.PasswordSlot(password, scryptParams, metadata)
+				if err != nil {
+					fmt.Fprintln(status, "Header Build Failed:", err)
+					os.Exit(1)
+				}
+				slots = append(slots, slot)
+			}
+		}
+		if decoy != nil {
+			slots = append(slots, decoy.slots...)
+		}
 
-	fmt.Printf("Writing %d encrypted body bits...\n", len(bodyBits))
-	WriteBitsAtPoints(img, bodyBits, bodyPoints)
+		fmt.Fprintf(status, "Writing %d header slots for %d recipient(s)...\n", len(slots), slotCount)
+		headerPoints, err := WriteHeader(img, slots, matchingStream)
+		if err != nil {
+			fmt.Fprintln(status, "Header Build Failed:", err)
+			os.Exit(1)
+		}
 
-	img.Save("output.png")
-	fmt.Println("Done. Saved output.png")
+		if *fecParity > 0 {
+			fmt.Fprintf(status, "Adding error correction (%d parity bytes per codeword)...\n", *fecParity)
+		}
+		bodyBits := BytesToBits(fecEncode(embeddedBody, *fecParity))
+
+		var decoyPoints []image.Point
+		if decoy != nil {
+			fmt.Fprintf(status, "Writing %d decoy body bits...\n", len(decoy.bits))
+			decoyPoints, err = img.EmbedBody(decoy.session.PixelSeed(), decoy.bits, decoy.mode, matchingStream)
+			if err != nil {
+				fmt.Fprintln(status, "Error: Image is too small to hold the decoy!", err)
+				os.Exit(1)
+			}
+		}
+
+		sessionSeed := session.PixelSeed()
+
+		fmt.Fprintf(status, "Writing %d encrypted body bits (%s)...\n", len(bodyBits), mode.Name)
+		bodyPoints, err := img.EmbedBody(sessionSeed, bodyBits, mode, matchingStream)
+		if err != nil {
+			fmt.Fprintln(status, "Error: Image is too small to hold this data!", err)
+			os.Exit(1)
+		}
+		if bodyPoints != nil {
+			fmt.Fprintf(status, "Body Pixels Used: %d of %d\n", len(bodyPoints), img.BodyCells())
+		}
+
+		if err := img.Save(outPaths[i]); err != nil {
+			fmt.Fprintln(status, "Error saving image:", err)
+			os.Exit(1)
+		}
+		if outPaths[i] != "-" {
+			fmt.Fprintln(status, "Done. Saved", outPaths[i])
+		}
+
+		if *debugMap != "" {
+			var pixels *EditableImage
+			switch c := img.(type) {
+			case *EditableImage:
+				pixels = c
+			case *PalettedImage:
+				pixels = c.truecolor()
+			}
+			var texture []int
+			if mode.Adaptive {
+				texture = textureMap(pixels)
+			}
+			if err := saveDebugMap(pixels, headerPoints, append(bodyPoints, decoyPoints...), texture, *debugMap); err != nil {
+				fmt.Fprintln(status, "Error saving debug map:", err)
+				os.Exit(1)
+			}
+			fmt.Fprintln(status, "Debug map saved to", *debugMap)
+		}
+	}
+}
+
+// saveDebugMap paints header pixels magenta and body pixels blue on a copy of
+// img. With a texture map the background is that map in grey, brighter where
+// adaptive embedding prefers to go. Never ship this next to the stego image:
+// it shows exactly what changed.
+func saveDebugMap(img *EditableImage, headerPoints, bodyPoints []image.Point, texture []int, path string) error {
+	debug := img.Clone()
+	debug.format = nil // Always a colour PNG, whatever the cover was
+
+	if texture != nil {
+		maxTexture := max(slices.Max(texture), 1)
+		for idx, t := range texture {
+			level := uint8(t * 255 / maxTexture)
+			debug.SetPixel(idx%img.Width(), idx/img.Width(), Pixel{R: level, G: level, B: level, A: 255})
+		}
+	}
 
 	for _, p := range headerPoints {
-		px := img.GetPixel(p.X, p.Y)
+		px := debug.GetPixel(p.X, p.Y)
 		px.R = 255
 		px.G = 0
 		px.B = 255
-		img.SetPixel(p.X, p.Y, px)
+		debug.SetPixel(p.X, p.Y, px)
 	}
 
 	for _, p := range bodyPoints {
-		px := img.GetPixel(p.X, p.Y)
+		px := debug.GetPixel(p.X, p.Y)
 		px.R = 0
 		px.G = 0
 		px.B = 255
-		img.SetPixel(p.X, p.Y, px)
+		debug.SetPixel(p.X, p.Y, px)
 	}
-	img.Save("output_debug.png")
-	fmt.Println("Debug map saved to output_debug.png")
+	return debug.Save(path)
 }
 
 func handleReveal(args []string) {
 	cmd := flag.NewFlagSet("reveal", flag.ExitOnError)
 	key := cmd.String("k", "", "Path to Your Private Key")
-	imgPath := cmd.String("i", "", "Path to input image")
+	imgPath := cmd.String("i", "", "Path to input image, or a directory or glob of the images a payload was split across")
+	outPath := cmd.String("o", "", "Write the hidden file to this path ('-' for stdout)")
+	outDir := cmd.String("outdir", "", "Write the hidden file into this directory under its original name")
+	asText := cmd.Bool("text", false, "Print the hidden data as text")
+	force := cmd.Bool("f", false, "Overwrite an existing output file")
+	verifyPath := cmd.String("verify", "", "Reject the image unless it is signed by this sender public key")
+	usePassword := cmd.Bool("password", false, "Open with a password instead of -k (prompted, or from $"+PasswordEnv+")")
+	maxSize := cmd.Int64("max-size", DefaultMaxPayloadSize, "Refuse compressed data that would inflate past this many bytes")
 	cmd.Parse(args)
 	keyPath := *key
 
-	if *imgPath == "" || keyPath == "" {
-		fmt.Println("Error: -i and -k are required.")
-		return
+	// Keep stdout clean for the file when it is the destination
+	status := os.Stdout
+	if *outPath == "-" {
+		status = os.Stderr
+	}
+
+	if *imgPath == "" || (keyPath == "") == !*usePassword {
+		fmt.Fprintln(status, "Error: -i and one of -k or -password are required.")
+		os.Exit(1)
+	}
+	paths, err := expandImagePaths(*imgPath)
+	if err != nil {
+		fmt.Fprintln(status, "Image Load Error:", err)
+		os.Exit(1)
+	}
+
+	var privKey *ecdh.PrivateKey
+	var password []byte
+	if *usePassword {
+		password, err = ReadPassword(false)
+		if err != nil {
+			fmt.Fprintln(status, "Password Error:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(status, "Trying the password on every header window; this can take a few seconds...")
+	} else {
+		keyObj, kType, err := LoadECCKey(keyPath)
+		if err != nil {
+			fmt.Fprintln(status, "Key Error:", err)
+			os.Exit(1)
+		}
+		if kType != KeyTypePrivate {
+			fmt.Fprintln(status, "Error: To reveal, you need private key")
+			os.Exit(1)
+		}
+		privKey = keyObj.(*ecdh.PrivateKey)
+	}
+
+	var verifyKey *ecdsa.PublicKey
+	if *verifyPath != "" {
+		keyObj, kType, err := LoadECDSAKey(*verifyPath)
+		if err != nil {
+			fmt.Fprintln(status, "Verification Key Error:", err)
+			os.Exit(1)
+		}
+		if kType != KeyTypePublic {
+			fmt.Fprintln(status, "Error: To verify, you need the SENDER'S PUBLIC KEY.")
+			os.Exit(1)
+		}
+		verifyKey = keyObj.(*ecdsa.PublicKey)
+	}
+
+	openHeader := func(img Carrier) (*HeaderMetadata, *EncryptionSession, error) {
+		if password != nil {
+			return ReadPasswordHeader(img, password)
+		}
+		return ReadHeader(img, privKey)
+	}
+
+	// With a directory or glob, images that fail are skipped; the shards
+	// that were found say what is still missing
+	var first *revealedShard
+	var shards [][]byte
+	for _, path := range paths {
+		if len(paths) > 1 {
+			fmt.Fprintf(status, "%s:\n", path)
+		}
+		shard, ok := revealShard(status, path, openHeader, verifyKey)
+		// A lone image may be from before header slots, which had one key
+		// and no signatures
+		if !ok && len(paths) == 1 && privKey != nil && verifyKey == nil {
+			if text, err := revealBaseline(path, privKey); err == nil {
+				fmt.Fprintln(status, "Read as an image from before header slots. That format is not authenticated, so damage would go unnoticed.")
+				if !writeRevealed(status, NewTextPayload(string(text)), *outPath, *outDir, *asText, *force) {
+					os.Exit(1)
+				}
+				return
+			}
+		}
+		if !ok {
+			if len(paths) == 1 {
+				os.Exit(1)
+			}
+			continue
+		}
+
+		m := shard.metadata
+		switch {
+		case first == nil:
+			first = shard
+			shards = make([][]byte, m.ShardCount)
+		case m.SetID != first.metadata.SetID || m.ShardCount != first.metadata.ShardCount ||
+			m.ShardsNeeded != first.metadata.ShardsNeeded || m.BodySize != first.metadata.BodySize:
+			fmt.Fprintln(status, "Skipped: part of a different hidden payload")
+			continue
+		}
+		shards[m.ShardIndex] = shard.data
+	}
+	if first == nil {
+		fmt.Fprintln(status, "Error: none of the images hold a payload for this key or password")
+		os.Exit(1)
+	}
+
+	metadata, session := first.metadata, first.session
+	needed := int(metadata.ShardsNeeded)
+	if len(shards) > 1 {
+		var missing []string
+		for i, shard := range shards {
+			if shard == nil {
+				missing = append(missing, strconv.Itoa(i+1))
+			}
+		}
+		found := len(shards) - len(missing)
+		fmt.Fprintf(status, "Found %d of %d shards, %d needed\n", found, len(shards), needed)
+		switch {
+		case found < needed:
+			fmt.Fprintf(status, "Error: missing shards %s of %d\n", strings.Join(missing, ", "), len(shards))
+			os.Exit(1)
+		case len(missing) > 0:
+			fmt.Fprintf(status, "Rebuilding missing shards %s from the spares\n", strings.Join(missing, ", "))
+		}
+	}
+
+	encryptedBodyBytes, err := joinShards(shards, needed, int(metadata.BodySize))
+	if err != nil {
+		fmt.Fprintln(status, "Error:", err)
+		os.Exit(1)
+	}
+
+	decryptedBody, err := session.DecryptBody(encryptedBodyBytes)
+	if errors.Is(err, ErrTampered) {
+		fmt.Fprintln(status, "Body Decryption Failed: image was tampered with")
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(status, "Body Decryption Failed:", err)
+		os.Exit(1)
+	}
+	var payload Payload
+	if err := payload.UnmarshalBinaryLimit(decryptedBody, *maxSize); err != nil {
+		fmt.Fprintln(status, "Payload Error:", err)
+		os.Exit(1)
+	}
+
+	if !writeRevealed(status, &payload, *outPath, *outDir, *asText, *force) {
+		os.Exit(1)
+	}
+}
+
+// writeRevealed saves or prints a revealed payload as the flags ask. On
+// failure it has already said why.
+func writeRevealed(status io.Writer, payload *Payload, outPath, outDir string, asText, force bool) bool {
+	name := payload.Name
+	if name == "" {
+		name = "(text)"
+	}
+	fmt.Fprintf(status, "Hidden File: %s, %d bytes, %s, mode %v, modified %s\n",
+		name, len(payload.Data), payload.ContentType, payload.Mode, payload.ModTime.Format(time.RFC3339))
+
+	switch {
+	case outPath != "":
+		if err := payload.WriteFile(outPath, force); err != nil {
+			fmt.Fprintln(status, "Error writing file:", err)
+			return false
+		}
+		if outPath != "-" {
+			fmt.Fprintln(status, "Saved", outPath)
+		}
+	case outDir != "":
+		dest := filepath.Join(outDir, payload.SafeName())
+		if err := payload.WriteFile(dest, force); err != nil {
+			fmt.Fprintln(status, "Error writing file:", err)
+			return false
+		}
+		fmt.Fprintln(status, "Saved", dest)
+	case asText:
+		if !payload.IsText() {
+			fmt.Fprintf(os.Stderr, "Warning: content type is %s, printing it anyway\n", payload.ContentType)
+		}
+		fmt.Fprintln(status, "Hidden Text:")
+		fmt.Fprintln(status, string(payload.Data))
+	default:
+		fmt.Fprintln(status, "Use -o or -outdir to save it, or -text to print it.")
 	}
-	img, err := load_png(*imgPath)
+	return true
+}
+
+// revealedShard is one image's part of the encrypted body, corrected and
+// checked against its signature.
+type revealedShard struct {
+	metadata *HeaderMetadata
+	session  *EncryptionSession
+	data     []byte
+}
+
+// revealShard opens the image at path and reads its part of the body. On
+// failure it has already said why.
+func revealShard(status io.Writer, path string, openHeader func(Carrier) (*HeaderMetadata, *EncryptionSession, error), verifyKey *ecdsa.PublicKey) (*revealedShard, bool) {
+	img, err := LoadCarrier(path)
 	if err != nil {
-		fmt.Println("Image Load Error:", err)
-		return
+		fmt.Fprintln(status, "Image Load Error:", err)
+		return nil, false
 	}
 
-	// NEW Header Size: 65 (Pub) + 16 (Encrypted Block) = 81 bytes
-	headerBytesLen := 81
-	headerPixels := ((headerBytesLen * 8) + 2) / 3
+	metadata, session, err := openHeader(img)
+	if errors.Is(err, ErrTampered) {
+		fmt.Fprintln(status, "Header Parse Failed: image was tampered with, or was not hidden for this key or password")
+		return nil, false
+	}
+	if err != nil {
+		fmt.Fprintln(status, "Header Parse Failed:", err)
+		return nil, false
+	}
 
-	headerPoints, err := GeneratePointsInRange(img.Width(), img.Height(), MasterSeed, headerPixels, 0, SplitPoint)
-	headerBits := ReadBitsAtPoints(img, headerPoints)
+	bodySize := metadata.BodySize
+	mode, err := metadata.EmbeddingMode()
+	if err == nil {
+		mode, err = img.CheckMode(mode)
+	}
+	if err != nil {
+		fmt.Fprintln(status, "Header Parse Failed:", err)
+		return nil, false
+	}
+	fmt.Fprintf(status, "Recovered Body Size: %d (AES-%d, %s)\n", bodySize, session.KeySize*8, mode.Name)
+	if metadata.DecoyBits > 0 {
+		mode.Avoid = &BodyLayout{Seed: session.DecoySession().PixelSeed(), CoverBits: int(metadata.DecoyBits)}
+	}
+	if metadata.ShardCount > 1 {
+		fmt.Fprintf(status, "Shard %d of %d\n", metadata.ShardIndex+1, metadata.ShardCount)
+	}
 
-	exactHeaderBits := headerBytesLen * 8
-	if len(headerBits) > exactHeaderBits {
-		headerBits = headerBits[:exactHeaderBits]
+	shardLen := shardSize(int(bodySize), int(metadata.ShardsNeeded))
+	embeddedSize := shardLen
+	if metadata.Signed() {
+		embeddedSize += SignatureSize
 	}
 
-	encryptedHeaderBytes := BitsToBytes(headerBits)
+	parity := int(metadata.Parity)
+	encodedSize := fecEncodedSize(embeddedSize, parity)
 
-	keyObj, kType, _ := LoadECCKey(keyPath)
-	if kType != KeyTypePrivate {
-		fmt.Println("Error: To reveal, you need private key")
-		return
+	// A cropped image is checked against the body region it was hidden in;
+	// the pixels now missing read as erasures
+	capacity := img.BodyCapacityBits(mode)
+	if mode.Cells > img.BodyCells() {
+		capacity = mode.Cells * img.MaxBitsPerCell(mode)
+	}
+	if bodySize < AEADOverhead || matrixCoverBits(encodedSize*8, mode.MatrixK) > capacity {
+		fmt.Fprintln(status, "Error: recovered body size does not fit this image")
+		return nil, false
 	}
 
-	privKey := keyObj.(*ecdh.PrivateKey)
+	// The pixel seed has its own HKDF label, independent of the AES keys
+	sessionSeed := session.PixelSeed()
 
-	decryptedMetadata, sharedKey, err := ParseHeader(privKey, encryptedHeaderBytes)
+	bodyBits, err := img.ExtractBody(sessionSeed, encodedSize*8, mode)
 	if err != nil {
-		fmt.Println("Header Parse Failed:", err)
-		return
+		fmt.Fprintln(status, "Error:", err)
+		return nil, false
 	}
 
-	headerBuf := bytes.NewReader(decryptedMetadata)
-	var bodySize int32
-	binary.Read(headerBuf, binary.LittleEndian, &bodySize)
+	embeddedBody, repaired, err := fecDecode(BitsToBytes(bodyBits), erasedBytes(bodyBits), embeddedSize, parity)
+	if err != nil {
+		fmt.Fprintln(status, "Error correction failed:", err)
+		return nil, false
+	}
+	if repaired > 0 {
+		fmt.Fprintf(status, "Corrected %d damaged body bytes\n", repaired)
+	}
+	data := embeddedBody[:shardLen]
+
+	// Check the signature before anything gets decrypted
+	switch {
+	case verifyKey != nil && !metadata.Signed():
+		fmt.Fprintln(status, "Verification Failed: image is not signed")
+		return nil, false
+	case verifyKey != nil:
+		sig := embeddedBody[shardLen:]
+		plainMetadata, _ := metadata.MarshalBinary()
+		if !VerifyEmbedded(verifyKey, plainMetadata, data, sig) {
+			fmt.Fprintln(status, "Verification Failed: image was not signed by this sender or was tampered with")
+			return nil, false
+		}
+		fmt.Fprintln(status, "Signature verified.")
+	case metadata.Signed():
+		fmt.Fprintln(status, "Note: image is signed; use -verify to check the sender.")
+	}
+	return &revealedShard{metadata: metadata, session: session, data: data}, true
+}
 
-	fmt.Println("Recovered Body Size:", bodySize)
+func handleKeygen(args []string) {
+	cmd := flag.NewFlagSet("keygen", flag.ExitOnError)
+	name := cmd.String("o", "", "Output name (writes <name>_private.pem and <name>_public.pem)")
+	force := cmd.Bool("f", false, "Overwrite existing key files")
+	cmd.Parse(args)
 
-	// Use shared key as seed source
-	sessionSeed := passwordToSeed(string(sharedKey))
+	if *name == "" {
+		fmt.Println("Error: -o is required.")
+		cmd.PrintDefaults()
+		os.Exit(1)
+	}
+
+	privPath := *name + "_private.pem"
+	pubPath := *name + "_public.pem"
+
+	// Check both up front so we never leave half a key pair behind
+	if !*force {
+		for _, p := range []string{privPath, pubPath} {
+			if _, err := os.Stat(p); err == nil {
+				fmt.Printf("Error: %s already exists (use -f to overwrite)\n", p)
+				os.Exit(1)
+			}
+		}
+	}
 
-	bodyPixels := ((int(bodySize) * 8) + 2) / 3
-	bodyPoints, _ := GeneratePointsInRange(img.Width(), img.Height(), sessionSeed, bodyPixels, SplitPoint, img.Width()*img.Height())
+	privPEM, pubPEM, err := GenerateECCKeyPair()
+	if err != nil {
+		fmt.Println("Key Generation Failed:", err)
+		os.Exit(1)
+	}
 
-	bodyBits := ReadBitsAtPoints(img, bodyPoints)
-	bodyBits = bodyBits[:bodySize*8]
+	if err := WriteKeyFile(privPath, privPEM, 0600, *force); err != nil {
+		fmt.Println("Error writing private key:", err)
+		os.Exit(1)
+	}
+	if err := WriteKeyFile(pubPath, pubPEM, 0644, *force); err != nil {
+		fmt.Println("Error writing public key:", err)
+		os.Exit(1)
+	}
 
-	encryptedBodyBytes := BitsToBytes(bodyBits)
+	// Make sure what we wrote is what hide/reveal will accept
+	if _, kType, err := LoadECCKey(privPath); err != nil || kType != KeyTypePrivate {
+		fmt.Println("Error: generated private key does not load:", err)
+		os.Exit(1)
+	}
+	if _, kType, err := LoadECCKey(pubPath); err != nil || kType != KeyTypePublic {
+		fmt.Println("Error: generated public key does not load:", err)
+		os.Exit(1)
+	}
 
-	decryptedBody, err := decryptBits(encryptedBodyBytes, sharedKey)
+	fingerprint, err := KeyFingerprint(pubPEM)
 	if err != nil {
-		fmt.Println("Body Decryption Failed:", err)
-		return
+		fmt.Println("Fingerprint Error:", err)
+		os.Exit(1)
 	}
-	fmt.Println("Hidden Text:")
-	fmt.Println(string(decryptedBody))
+
+	fmt.Println("Private key saved to", privPath)
+	fmt.Println("Public key saved to", pubPath)
+	fmt.Println("Fingerprint:", fingerprint)
 }
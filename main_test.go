@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The command tests run the test binary itself as imgcrypt, so that every
+// error path can still end in os.Exit.
+const testMainEnv = "IMGCRYPT_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testMainEnv) == "1" {
+		os.Args = append([]string{"imgcrypt"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// imgcrypt runs a subcommand and returns its output and whether it exited
+// with status 0. env is added to the environment, e.g. the password.
+func imgcrypt(t *testing.T, env []string, args ...string) (string, bool) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), testMainEnv+"=1"), env...)
+	out, err := cmd.CombinedOutput()
+	if _, exited := err.(*exec.ExitError); err != nil && !exited {
+		t.Fatal(err)
+	}
+	return string(out), err == nil
+}
+
+func mustRun(t *testing.T, env []string, args ...string) string {
+	t.Helper()
+	out, ok := imgcrypt(t, env, args...)
+	if !ok {
+		t.Fatalf("imgcrypt %s failed:\n%s", strings.Join(args, " "), out)
+	}
+	return out
+}
+
+// keyPair writes a key pair into dir and returns its private and public
+// key paths.
+func keyPair(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	base := filepath.Join(dir, name)
+	mustRun(t, nil, "keygen", "-o", base)
+	return base + "_private.pem", base + "_public.pem"
+}
+
+// noisyRGBA is an opaque image of random pixels.
+func noisyRGBA(w, h int, seed int64) *image.NRGBA {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	rng.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestPNG(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, buf.Bytes())
+}
+
+func TestKeygen(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+
+	info, err := os.Stat(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("private key mode %v, want 0600", info.Mode().Perm())
+	}
+	if _, kType, err := LoadECCKey(priv); err != nil || kType != KeyTypePrivate {
+		t.Errorf("private key: type %v, %v", kType, err)
+	}
+	if _, kType, err := LoadECCKey(pub); err != nil || kType != KeyTypePublic {
+		t.Errorf("public key: type %v, %v", kType, err)
+	}
+
+	before, _ := os.ReadFile(priv)
+	if _, ok := imgcrypt(t, nil, "keygen", "-o", filepath.Join(dir, "bob")); ok {
+		t.Error("keygen overwrote a key pair without -f")
+	}
+	if after, _ := os.ReadFile(priv); !bytes.Equal(before, after) {
+		t.Error("private key changed without -f")
+	}
+	mustRun(t, nil, "keygen", "-o", filepath.Join(dir, "bob"), "-f")
+	if after, _ := os.ReadFile(priv); bytes.Equal(before, after) {
+		t.Error("keygen -f kept the old key")
+	}
+}
+
+func TestHideReveal(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 1))
+
+	mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-t", "meet me at the old mill")
+	if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "meet me at the old mill") {
+		t.Errorf("reveal printed:\n%s", got)
+	}
+}
+
+func TestFailuresExitNonZero(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{},
+		{"bogus"},
+		{"hide", "-t", "x"},
+		{"reveal", "-i", filepath.Join(dir, "missing.png"), "-k", filepath.Join(dir, "missing.pem")},
+		{"keygen"},
+	} {
+		if out, ok := imgcrypt(t, nil, args...); ok {
+			t.Errorf("imgcrypt %v exited 0:\n%s", args, out)
+		}
+	}
+}
+
+func TestAESKeySizes(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover := filepath.Join(dir, "cover.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 2))
+
+	for _, bits := range []string{"128", "192", "256"} {
+		out := filepath.Join(dir, "out"+bits+".png")
+		mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-t", "AES-"+bits, "-aes", bits)
+		got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text")
+		if !strings.Contains(got, "(AES-"+bits+",") || !strings.Contains(got, "\nAES-"+bits+"\n") {
+			t.Errorf("-aes %s: reveal printed:\n%s", bits, got)
+		}
+	}
+	if _, ok := imgcrypt(t, nil, "hide", "-k", pub, "-i", cover, "-o", filepath.Join(dir, "x.png"), "-t", "x", "-aes", "160"); ok {
+		t.Error("-aes 160 accepted")
+	}
+}
+
+func TestRevealWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := keyPair(t, dir, "bob")
+	evePriv, _ := keyPair(t, dir, "eve")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 2))
+
+	mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-t", "secret")
+	if got, ok := imgcrypt(t, nil, "reveal", "-k", evePriv, "-i", out, "-text"); ok || strings.Contains(got, "secret") {
+		t.Errorf("reveal with the wrong key succeeded:\n%s", got)
+	}
+}
+
+func TestHideOutput(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover := filepath.Join(dir, "cover.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 3))
+
+	// No -o writes output.png in the working directory, and no debug map
+	cmd := exec.Command(os.Args[0], "hide", "-k", pub, "-i", cover, "-t", "default path")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), testMainEnv+"=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("hide: %v\n%s", err, out)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.Contains(e.Name(), "debug") || strings.HasPrefix(e.Name(), ".") {
+			t.Errorf("hide left %s behind", e.Name())
+		}
+	}
+	if got := mustRun(t, nil, "reveal", "-k", priv, "-i", filepath.Join(dir, "output.png"), "-text"); !strings.Contains(got, "default path") {
+		t.Errorf("reveal printed:\n%s", got)
+	}
+
+	// -o - writes the image to stdout and keeps the status on stderr
+	var stdout bytes.Buffer
+	cmd = exec.Command(os.Args[0], "hide", "-k", pub, "-i", cover, "-t", "to stdout", "-o", "-")
+	cmd.Env = append(os.Environ(), testMainEnv+"=1")
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	piped := filepath.Join(dir, "piped.png")
+	writeFile(t, piped, stdout.Bytes())
+	if got := mustRun(t, nil, "reveal", "-k", priv, "-i", piped, "-text"); !strings.Contains(got, "to stdout") {
+		t.Errorf("reveal printed:\n%s", got)
+	}
+
+	// -debug-map writes a map the size of the image
+	out, debug := filepath.Join(dir, "out.png"), filepath.Join(dir, "map.png")
+	mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-t", "mapped", "-debug-map", debug)
+	f, err := os.Open(debug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Bounds().Dx() != 120 || m.Bounds().Dy() != 100 {
+		t.Errorf("debug map is %v", m.Bounds())
+	}
+}
+
+func TestHideRevealFile(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 4))
+
+	secret := filepath.Join(dir, "secret.bin")
+	data := []byte{0, 1, 2, 0xff, '\n', 0x80, 0}
+	writeFile(t, secret, data)
+	if err := os.Chmod(secret, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1600000000, 0)
+	if err := os.Chtimes(secret, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-tf", secret)
+
+	outDir := filepath.Join(dir, "revealed")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-outdir", outDir)
+	got := filepath.Join(outDir, "secret.bin")
+	if b, err := os.ReadFile(got); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("revealed %q, %v", b, err)
+	}
+	info, err := os.Stat(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime) {
+		t.Errorf("revealed mode %v, modified %v", info.Mode().Perm(), info.ModTime())
+	}
+
+	// An existing file is kept unless -f is given
+	writeFile(t, got, []byte("keep me"))
+	if _, ok := imgcrypt(t, nil, "reveal", "-k", priv, "-i", out, "-outdir", outDir); ok {
+		t.Error("reveal overwrote a file without -f")
+	}
+	if b, _ := os.ReadFile(got); string(b) != "keep me" {
+		t.Error("existing file changed without -f")
+	}
+	renamed := filepath.Join(dir, "renamed.bin")
+	mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-o", renamed)
+	if b, err := os.ReadFile(renamed); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("-o wrote %q, %v", b, err)
+	}
+
+	// Without -o, -outdir or -text nothing is printed or written
+	if msg := mustRun(t, nil, "reveal", "-k", priv, "-i", out); !strings.Contains(msg, "secret.bin") || strings.Contains(msg, "\x80") {
+		t.Errorf("reveal printed:\n%q", msg)
+	}
+}
+
+func TestSignedReveal(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	alicePriv, alicePub := keyPair(t, dir, "alice")
+	_, evePub := keyPair(t, dir, "eve")
+	cover := filepath.Join(dir, "cover.png")
+	signed, unsigned := filepath.Join(dir, "signed.png"), filepath.Join(dir, "unsigned.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 5))
+
+	mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", signed, "-t", "from alice", "-sign", alicePriv)
+	mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", unsigned, "-t", "from anyone")
+
+	if got := mustRun(t, nil, "reveal", "-k", priv, "-i", signed, "-text", "-verify", alicePub); !strings.Contains(got, "from alice") {
+		t.Errorf("reveal -verify printed:\n%s", got)
+	}
+	if got := mustRun(t, nil, "reveal", "-k", priv, "-i", signed, "-text"); !strings.Contains(got, "use -verify") {
+		t.Errorf("reveal without -verify printed:\n%s", got)
+	}
+	if got, ok := imgcrypt(t, nil, "reveal", "-k", priv, "-i", signed, "-text", "-verify", evePub); ok || strings.Contains(got, "from alice") {
+		t.Errorf("verified against the wrong sender:\n%s", got)
+	}
+	if got, ok := imgcrypt(t, nil, "reveal", "-k", priv, "-i", unsigned, "-text", "-verify", alicePub); ok || strings.Contains(got, "from anyone") {
+		t.Errorf("unsigned image passed -verify:\n%s", got)
+	}
+	if _, ok := imgcrypt(t, nil, "hide", "-k", pub, "-i", cover, "-o", signed, "-t", "x", "-sign", alicePub); ok {
+		t.Error("hide signed with a public key")
+	}
+}
+
+func TestMultipleRecipients(t *testing.T) {
+	dir := t.TempDir()
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 6))
+	evePriv, _ := keyPair(t, dir, "eve")
+
+	args := []string{"hide", "-i", cover, "-o", out, "-t", "for all three"}
+	var privs []string
+	for _, name := range []string{"alice", "bob", "carol"} {
+		priv, pub := keyPair(t, dir, name)
+		privs = append(privs, priv)
+		args = append(args, "-k", pub)
+	}
+	mustRun(t, nil, args...)
+
+	for _, priv := range privs {
+		if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "for all three") {
+			t.Errorf("%s: reveal printed:\n%s", filepath.Base(priv), got)
+		}
+	}
+	if got, ok := imgcrypt(t, nil, "reveal", "-k", evePriv, "-i", out, "-text"); ok || strings.Contains(got, "for all three") {
+		t.Errorf("reveal for a fourth key succeeded:\n%s", got)
+	}
+
+	// One slot per recipient, so there is a limit
+	_, pub := keyPair(t, dir, "dave")
+	args = []string{"hide", "-i", cover, "-o", out, "-t", "x"}
+	for i := 0; i <= MaxRecipients; i++ {
+		args = append(args, "-k", pub)
+	}
+	if _, ok := imgcrypt(t, nil, args...); ok {
+		t.Errorf("hide took %d recipients", MaxRecipients+1)
+	}
+}
+
+func TestPasswordRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 7))
+	password := []string{PasswordEnv + "=correct horse"}
+
+	mustRun(t, password, "hide", "-password", "-i", cover, "-o", out, "-t", "by password", "-kdf-cost", "16")
+	if got := mustRun(t, password, "reveal", "-password", "-i", out, "-text"); !strings.Contains(got, "by password") {
+		t.Errorf("reveal printed:\n%s", got)
+	}
+	for _, cost := range []string{"14", "19", "271"} {
+		if _, ok := imgcrypt(t, password, "hide", "-password", "-i", cover, "-o", out, "-t", "x", "-kdf-cost", cost); ok {
+			t.Errorf("-kdf-cost %s accepted", cost)
+		}
+	}
+	// A wrong password runs scrypt for every window
+	if testing.Short() {
+		return
+	}
+	if _, ok := imgcrypt(t, []string{PasswordEnv + "=battery staple"}, "reveal", "-password", "-i", out, "-text"); ok {
+		t.Error("reveal with the wrong password succeeded")
+	}
+}
+
+func TestDepthAndAlpha(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover := filepath.Join(dir, "cover.png")
+	img := noisyRGBA(120, 100, 8)
+	// Every other row is translucent, which -alpha must leave alone
+	for y := 0; y < 100; y += 2 {
+		for x := 0; x < 120; x++ {
+			img.Pix[img.PixOffset(x, y)+3] = 0x80
+		}
+	}
+	writeTestPNG(t, cover, img)
+
+	for _, tt := range []struct {
+		depth string
+		alpha bool
+	}{{"1", false}, {"2", true}, {"3", false}, {"4", true}} {
+		out := filepath.Join(dir, "out"+tt.depth+".png")
+		args := []string{"hide", "-k", pub, "-i", cover, "-o", out, "-t", "depth " + tt.depth, "-depth", tt.depth}
+		if tt.alpha {
+			args = append(args, "-alpha")
+		}
+		mustRun(t, nil, args...)
+		if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "depth "+tt.depth) {
+			t.Errorf("-depth %s: reveal printed:\n%s", tt.depth, got)
+		}
+
+		f, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stego, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		depth := int(tt.depth[0] - '0')
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 120; x++ {
+				before := img.Pix[img.PixOffset(x, y):]
+				after := stego.(*image.NRGBA).Pix[img.PixOffset(x, y):]
+				for c := 0; c < 3; c++ {
+					if before[c]>>depth != after[c]>>depth {
+						t.Fatalf("-depth %s changed (%d,%d) channel %d from %d to %d", tt.depth, x, y, c, before[c], after[c])
+					}
+				}
+				if a := after[3]; (before[3] != 0xff || !tt.alpha) && a != before[3] || before[3] == 0xff && a < 0xfe {
+					t.Fatalf("-depth %s changed alpha at (%d,%d) from %d to %d", tt.depth, x, y, before[3], a)
+				}
+			}
+		}
+	}
+	if _, ok := imgcrypt(t, nil, "hide", "-k", pub, "-i", cover, "-o", filepath.Join(dir, "x.png"), "-t", "x", "-depth", "5"); ok {
+		t.Error("-depth 5 accepted")
+	}
+}
+
+func TestMatchingRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover := filepath.Join(dir, "cover.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 9))
+
+	for _, depth := range []string{"1", "3"} {
+		out := filepath.Join(dir, "out"+depth+".png")
+		mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-t", "matched", "-matching", "-depth", depth)
+		if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "matched") {
+			t.Errorf("-depth %s: reveal printed:\n%s", depth, got)
+		}
+	}
+}
+
+func TestMatrixCommand(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 10))
+
+	msg := mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-t", "fewer changes", "-matrix", "-matching")
+	if !strings.Contains(msg, "Matrix embedding") || strings.Contains(msg, "Matrix embedding: 1 bits") {
+		t.Errorf("hide picked no matrix code for a short message:\n%s", msg)
+	}
+	if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "fewer changes") {
+		t.Errorf("reveal printed:\n%s", got)
+	}
+}
+
+func TestAdaptiveRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover := filepath.Join(dir, "cover.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 12))
+
+	for i, extra := range [][]string{nil, {"-matching", "-depth", "2"}, {"-matrix"}} {
+		out := filepath.Join(dir, fmt.Sprintf("out%d.png", i))
+		mustRun(t, nil, append([]string{"hide", "-k", pub, "-i", cover, "-o", out, "-t", "in the texture", "-adaptive"}, extra...)...)
+		if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "in the texture") {
+			t.Errorf("-adaptive %v: reveal printed:\n%s", extra, got)
+		}
+	}
+}
+
+func TestFECRepairsDamage(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 16))
+	mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-t", strings.Repeat("survives damage ", 40), "-fec", "32")
+
+	// Flip the low red bit of scattered body pixels
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stego, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := stego.(*image.RGBA) // Opaque, so the same as NRGBA
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 40; i++ {
+		idx := SplitPoint + rng.Intn(120*100-SplitPoint)
+		img.Pix[idx*4] ^= 1
+	}
+	writeTestPNG(t, out, img)
+
+	if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "survives damage") {
+		t.Errorf("reveal printed:\n%s", got)
+	}
+}
+
+// Text far larger than the image holds fits once compressed
+func TestHideCompressed(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(120, 100, 17))
+	text := strings.Repeat("all work and no play makes jack a dull boy\n", 500)
+
+	if msg := mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-t", text); !strings.Contains(msg, "Compressed") {
+		t.Errorf("hide printed:\n%s", msg)
+	}
+	if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, text) {
+		t.Error("reveal lost some of the text")
+	}
+}
+
+func TestShardsCommand(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	args := []string{"hide", "-k", pub, "-spare", "1", "-o", filepath.Join(dir, "out"), "-t", "split three ways"}
+	for i := 0; i < 3; i++ {
+		cover := filepath.Join(dir, "cover"+string(rune('a'+i))+".png")
+		writeTestPNG(t, cover, noisyRGBA(120, 100, int64(20+i)))
+		args = append(args, "-i", cover)
+	}
+	mustRun(t, nil, args...)
+
+	// Any two of the three rebuild the payload
+	if err := os.Remove(filepath.Join(dir, "out-2.png")); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustRun(t, nil, "reveal", "-k", priv, "-i", filepath.Join(dir, "out-*.png"), "-text"); !strings.Contains(got, "split three ways") {
+		t.Errorf("reveal printed:\n%s", got)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "out-3.png")); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := imgcrypt(t, nil, "reveal", "-k", priv, "-i", filepath.Join(dir, "out-*.png"), "-text"); ok {
+		t.Errorf("revealed from one of three shards:\n%s", got)
+	}
+}
+
+func TestDecoyCommand(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	decoyPriv, decoyPub := keyPair(t, dir, "mallory")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(200, 150, 4))
+
+	mustRun(t, nil, "hide", "-k", pub, "-i", cover, "-o", out, "-t", "the real plans",
+		"-decoy-k", decoyPub, "-decoy-t", "a shopping list")
+
+	if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "the real plans") {
+		t.Errorf("real key revealed:\n%s", got)
+	}
+	got := mustRun(t, nil, "reveal", "-k", decoyPriv, "-i", out, "-text")
+	if !strings.Contains(got, "a shopping list") || strings.Contains(got, "the real plans") {
+		t.Errorf("decoy key revealed:\n%s", got)
+	}
+}
+
+// The same key on both sides is refused, even from a copy of the key file
+func TestDecoyKeyOverlap(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := keyPair(t, dir, "bob")
+	_, otherPub := keyPair(t, dir, "carol")
+	cover, out := filepath.Join(dir, "cover.png"), filepath.Join(dir, "out.png")
+	writeTestPNG(t, cover, noisyRGBA(200, 150, 5))
+	pemData, err := os.ReadFile(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := filepath.Join(dir, "copy.pem")
+	writeFile(t, copied, pemData)
+
+	msg, ok := imgcrypt(t, nil, "hide", "-k", otherPub, "-k", pub, "-i", cover, "-o", out, "-t", "real",
+		"-decoy-k", copied, "-decoy-t", "decoy")
+	if ok || !strings.Contains(msg, "-decoy-k") {
+		t.Errorf("overlapping keys accepted:\n%s", msg)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("an image was written for overlapping keys")
+	}
+}
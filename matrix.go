@@ -0,0 +1,82 @@
+package main
+
+import "slices"
+
+// Matrix embedding with binary Hamming codes, as in F5. A block of
+// n = 2^k - 1 cover bits carries k message bits as its syndrome: the XOR of
+// the (1-based) positions of its set bits. Any syndrome can be reached by
+// flipping at most one bit, so k bits cost at most one change instead of
+// about k/2. k = 1 is plain embedding, one message bit per cover bit.
+
+// MaxMatrixK bounds the block size at 1023 cover bits.
+const MaxMatrixK = 10
+
+// matrixCoverBits is how many cover bits messageBits need at k.
+func matrixCoverBits(messageBits, k int) int {
+	blocks := (messageBits + k - 1) / k
+	return blocks * (1<<k - 1)
+}
+
+// chooseMatrixK picks the largest k whose blocks still fit in capacityBits.
+// Larger k changes fewer bits per message bit but needs more cover.
+func chooseMatrixK(messageBits, capacityBits int) int {
+	for k := MaxMatrixK; k > 1; k-- {
+		if matrixCoverBits(messageBits, k) <= capacityBits {
+			return k
+		}
+	}
+	return 1
+}
+
+func syndrome(block []int) int {
+	s := 0
+	for i, bit := range block {
+		if bit == 1 {
+			s ^= i + 1
+		}
+	}
+	return s
+}
+
+// matrixEmbed returns a copy of cover whose block syndromes spell message.
+// cover must hold matrixCoverBits(len(message), k) bits.
+func matrixEmbed(cover, message []int, k int) []int {
+	n := 1<<k - 1
+	stego := append([]int(nil), cover...)
+
+	for b := 0; b*k < len(message); b++ {
+		block := stego[b*n : (b+1)*n]
+
+		want := 0
+		for j := 0; j < k; j++ {
+			want <<= 1
+			if i := b*k + j; i < len(message) {
+				want |= message[i]
+			}
+		}
+		if flip := syndrome(block) ^ want; flip != 0 {
+			block[flip-1] ^= 1
+		}
+	}
+	return stego
+}
+
+// matrixExtract reads messageBits back from the block syndromes of stego.
+// A block with an unknown (-1) bit gives k unknown bits.
+func matrixExtract(stego []int, messageBits, k int) []int {
+	n := 1<<k - 1
+	message := make([]int, 0, messageBits+k)
+
+	for b := 0; len(message) < messageBits; b++ {
+		block := stego[b*n : (b+1)*n]
+		s := syndrome(block)
+		for j := k - 1; j >= 0; j-- {
+			if slices.Contains(block, -1) {
+				message = append(message, -1)
+			} else {
+				message = append(message, s>>j&1)
+			}
+		}
+	}
+	return message[:messageBits]
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+func TestMatrixRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	randomBits := func(n int) []int {
+		bits := make([]int, n)
+		for i := range bits {
+			bits[i] = rng.Intn(2)
+		}
+		return bits
+	}
+
+	for k := 1; k <= 6; k++ {
+		message := randomBits(100)
+		cover := randomBits(matrixCoverBits(len(message), k))
+		stego := matrixEmbed(cover, message, k)
+
+		if got := matrixExtract(stego, len(message), k); !slices.Equal(got, message) {
+			t.Fatalf("k=%d: extracted %v, want %v", k, got, message)
+		}
+
+		// At most one change per block
+		n := 1<<k - 1
+		for b := 0; b < len(cover)/n; b++ {
+			changed := 0
+			for i := b * n; i < (b+1)*n; i++ {
+				if stego[i] != cover[i] {
+					changed++
+				}
+			}
+			if changed > 1 {
+				t.Fatalf("k=%d: block %d has %d changes", k, b, changed)
+			}
+		}
+	}
+}
+
+func TestMatrixUnknownBits(t *testing.T) {
+	message := []int{1, 0, 1, 1, 0, 0}
+	stego := matrixEmbed(make([]int, matrixCoverBits(len(message), 3)), message, 3)
+	stego[9] = -1
+	want := []int{1, 0, 1, -1, -1, -1}
+	if got := matrixExtract(stego, len(message), 3); !slices.Equal(got, want) {
+		t.Errorf("extracted %v, want %v", got, want)
+	}
+}
+
+func TestChooseMatrixK(t *testing.T) {
+	if k := chooseMatrixK(100, 100); k != 1 {
+		t.Errorf("no spare capacity: k = %d, want 1", k)
+	}
+	k := chooseMatrixK(100, 1000)
+	if matrixCoverBits(100, k) > 1000 || matrixCoverBits(100, k+1) <= 1000 {
+		t.Errorf("k = %d is not the largest that fits", k)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"slices"
+)
+
+// Palette carrier: EzStego. The palette is put in order and every pixel
+// carries one bit in the parity of its colour's place in that order.
+// Changing a bit moves the pixel to a neighbouring colour in the order. The
+// palette itself is never touched, so the output keeps its size and reveal
+// orders it the same way.
+//
+// Plain luminance order pairs up colours of the same brightness but any hue,
+// which on web palettes puts pairs about 170 apart. So the order starts at
+// the darkest colour and always steps to the nearest one left, falling back
+// to luminance order on ties. That brings pairs down to about 50 on the same
+// palettes, roughly their grid step.
+//
+// Transparent entries are left out of the order, since a pixel must never
+// become or stop being transparent, and so is the last entry when an odd
+// number remain, as it has nothing to pair with. Pixels of those colours
+// carry nothing. One bit per pixel; the header windows come first, then the
+// body, as for JPEG.
+
+// paletteSlotCells is the size of one header window, the slot plus a
+// quarter. Palette images are often small, so the margin is kept tight.
+const paletteSlotCells = SlotSize * 8 * 5 / 4
+
+// paletteModes is the only way bits go into a palette image.
+var paletteModes = []EmbeddingMode{{Name: "ezstego", Depth: 1, MatrixK: 1}}
+
+// paletteFormat writes an edited palette image back in its file format.
+type paletteFormat interface {
+	ext() string
+	encodePaletted(w io.Writer, img *image.Paletted) error
+}
+
+// PalettedImage is an 8-bit indexed image: a PNG with a palette, or the
+// first frame of a GIF.
+type PalettedImage struct {
+	Img    *image.Paletted
+	format paletteFormat
+
+	order []uint8 // Usable palette indices in embedding order
+	rank  [256]int
+	cells []int // Offsets into Img.Pix of the pixels that carry bits
+}
+
+func newPalettedImage(img *image.Paletted, format paletteFormat) *PalettedImage {
+	p := &PalettedImage{Img: img, format: format}
+
+	// Rec. 601 luma, ties broken by index so the order is always the same
+	luma := func(i uint8) int {
+		r, g, b, _ := img.Palette[i].RGBA()
+		return int(299*r + 587*g + 114*b)
+	}
+	for i, c := range img.Palette {
+		if _, _, _, a := c.RGBA(); a == 0xffff && i < 256 {
+			p.order = append(p.order, uint8(i))
+		}
+	}
+	slices.SortFunc(p.order, func(a, b uint8) int {
+		return cmp.Or(cmp.Compare(luma(a), luma(b)), cmp.Compare(a, b))
+	})
+	for k := 1; k < len(p.order); k++ {
+		nearest := k
+		for j := k + 1; j < len(p.order); j++ {
+			if colourDistance(img.Palette[p.order[k-1]], img.Palette[p.order[j]]) <
+				colourDistance(img.Palette[p.order[k-1]], img.Palette[p.order[nearest]]) {
+				nearest = j
+			}
+		}
+		p.order[k], p.order[nearest] = p.order[nearest], p.order[k]
+	}
+	p.order = p.order[:len(p.order)&^1]
+
+	for i := range p.rank {
+		p.rank[i] = -1
+	}
+	for r, i := range p.order {
+		p.rank[i] = r
+	}
+
+	bounds := img.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if off := y*img.Stride + x; p.rank[img.Pix[off]] >= 0 {
+				p.cells = append(p.cells, off)
+			}
+		}
+	}
+	return p
+}
+
+// colourDistance is the squared RGB distance at 8 bits per channel.
+func colourDistance(a, b color.Color) int {
+	r1, g1, b1, _ := a.RGBA()
+	r2, g2, b2, _ := b.RGBA()
+	dr, dg, db := int(r1>>8)-int(r2>>8), int(g1>>8)-int(g2>>8), int(b1>>8)-int(b2>>8)
+	return dr*dr + dg*dg + db*db
+}
+
+// getBit reads -1 for a pixel that has since been cropped away.
+func (p *PalettedImage) getBit(off int) int {
+	if off < 0 {
+		return -1
+	}
+	return p.rank[p.Img.Pix[off]] & 1
+}
+
+// setBit moves the pixel to the neighbouring colour when its parity is
+// wrong: the other one of its pair, or with rng either neighbour (LSB
+// matching on the sorted order).
+func (p *PalettedImage) setBit(off, bit int, rng *keyStream) {
+	r := p.rank[p.Img.Pix[off]]
+	if r&1 == bit {
+		return
+	}
+	switch {
+	case rng == nil:
+		r ^= 1
+	case r == 0:
+		r++
+	case r == len(p.order)-1 || rng.Intn(2) == 0:
+		r--
+	default:
+		r++
+	}
+	p.Img.Pix[off] = p.order[r]
+}
+
+// point is the pixel at off, counted from the top left of the image.
+func (p *PalettedImage) point(off int) image.Point {
+	return image.Pt(off%p.Img.Stride, off/p.Img.Stride)
+}
+
+func (p *PalettedImage) Width() int {
+	return p.Img.Bounds().Dx()
+}
+
+func (p *PalettedImage) Height() int {
+	return p.Img.Bounds().Dy()
+}
+
+func (p *PalettedImage) Ext() string {
+	return p.format.ext()
+}
+
+func (p *PalettedImage) Modes() []EmbeddingMode {
+	return paletteModes
+}
+
+// CheckMode allows matching, which picks either neighbour in the order.
+func (p *PalettedImage) CheckMode(mode EmbeddingMode) (EmbeddingMode, error) {
+	if mode.Depth != 1 || mode.Alpha || mode.Adaptive {
+		return mode, errors.New("palette images only support 1 bit per pixel (-matrix and -matching are fine)")
+	}
+	mode.Name = paletteModes[0].Name
+	return mode, nil
+}
+
+func (p *PalettedImage) MaxBitsPerCell(mode EmbeddingMode) int {
+	return 1
+}
+
+func (p *PalettedImage) HeaderCells() int {
+	return min(HeaderSlots*paletteSlotCells, len(p.cells))
+}
+
+func (p *PalettedImage) BodyCells() int {
+	return len(p.cells) - p.HeaderCells()
+}
+
+func (p *PalettedImage) BodyCapacityBits(mode EmbeddingMode) int {
+	return p.BodyCells()
+}
+
+// slotCells picks nbits pixels of header window in seed order.
+func (p *PalettedImage) slotCells(window int, seed []byte, nbits int) ([]int, error) {
+	if (window+1)*paletteSlotCells > len(p.cells) {
+		return nil, errors.New("palette image has too few usable pixels for a header")
+	}
+	if nbits > paletteSlotCells {
+		return nil, errors.New("header slot does not fit its window")
+	}
+
+	inWindow := p.cells[window*paletteSlotCells : (window+1)*paletteSlotCells]
+	picked := make([]int, nbits)
+	for i, offset := range newKeyStream(seed).shuffledPrefix(paletteSlotCells, nbits) {
+		picked[i] = inWindow[offset]
+	}
+	return picked, nil
+}
+
+func (p *PalettedImage) WriteSlot(window int, seed []byte, bits []int, rng *keyStream) ([]image.Point, error) {
+	cells, err := p.slotCells(window, seed, len(bits))
+	if err != nil {
+		return nil, err
+	}
+	points := make([]image.Point, len(cells))
+	for i, cell := range cells {
+		p.setBit(cell, bits[i], rng)
+		points[i] = p.point(cell)
+	}
+	return points, nil
+}
+
+func (p *PalettedImage) ReadSlot(window int, seed []byte, nbits int) ([]int, error) {
+	cells, err := p.slotCells(window, seed, nbits)
+	if err != nil {
+		return nil, err
+	}
+	bits := make([]int, nbits)
+	for i, cell := range cells {
+		bits[i] = p.getBit(cell)
+	}
+	return bits, nil
+}
+
+// bodyCells picks count body pixels in seed order, out of the mode.Cells
+// body pixels there were at hide time if set. Those since cropped away come
+// back as -1.
+func (p *PalettedImage) bodyCells(seed []byte, count int, mode EmbeddingMode) ([]int, error) {
+	window := p.BodyCells()
+	if mode.Cells > 0 {
+		window = mode.Cells
+	}
+	offsets, err := bodyOffsets(seed, count, window, mode)
+	if err != nil {
+		return nil, err
+	}
+	cells := p.cells[p.HeaderCells():]
+	picked := make([]int, count)
+	for i, offset := range offsets {
+		picked[i] = -1
+		if offset < len(cells) {
+			picked[i] = cells[offset]
+		}
+	}
+	return picked, nil
+}
+
+func (p *PalettedImage) EmbedBody(seed []byte, bits []int, mode EmbeddingMode, rng *keyStream) ([]image.Point, error) {
+	cells, err := p.bodyCells(seed, matrixCoverBits(len(bits), mode.MatrixK), mode)
+	if err != nil {
+		return nil, err
+	}
+	if !mode.Matching {
+		rng = nil
+	}
+
+	cover := make([]int, len(cells))
+	for i, cell := range cells {
+		cover[i] = p.getBit(cell)
+	}
+	points := make([]image.Point, len(cells))
+	for i, bit := range matrixEmbed(cover, bits, mode.MatrixK) {
+		p.setBit(cells[i], bit, rng)
+		points[i] = p.point(cells[i])
+	}
+	return points, nil
+}
+
+func (p *PalettedImage) ExtractBody(seed []byte, nbits int, mode EmbeddingMode) ([]int, error) {
+	cells, err := p.bodyCells(seed, matrixCoverBits(nbits, mode.MatrixK), mode)
+	if err != nil {
+		return nil, errors.New("recovered body size does not fit this image")
+	}
+
+	stego := make([]int, len(cells))
+	for i, cell := range cells {
+		stego[i] = p.getBit(cell)
+	}
+	return matrixExtract(stego, nbits, mode.MatrixK), nil
+}
+
+// truecolor is a copy of the image for debug maps.
+func (p *PalettedImage) truecolor() *EditableImage {
+	bounds := p.Img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), p.Img, bounds.Min, draw.Src)
+	return &EditableImage{Img: dst}
+}
+
+func (p *PalettedImage) Encode(w io.Writer) error {
+	return p.format.encodePaletted(w, p.Img)
+}
+
+// Save writes the image atomically, see saveEncoded.
+func (p *PalettedImage) Save(filename string) error {
+	return saveEncoded(filename, p)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// smallPalette has n opaque colours and, last, a transparent one.
+func smallPalette(n int) color.Palette {
+	rng := rand.New(rand.NewSource(int64(n)))
+	p := color.Palette{}
+	for i := 0; i < n; i++ {
+		p = append(p, color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 0xff})
+	}
+	return append(p, color.NRGBA{})
+}
+
+func noisyPaletted(w, h int, pal color.Palette, seed int64) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, w, h), pal)
+	rng := rand.New(rand.NewSource(seed))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.Intn(len(pal)))
+	}
+	return img
+}
+
+// Transparent pixels carry nothing and never change, whatever is written
+func TestPaletteTransparentLeftAlone(t *testing.T) {
+	img := noisyPaletted(60, 40, smallPalette(7), 1)
+	before := append([]uint8(nil), img.Pix...)
+	p := newPalettedImage(img, nil)
+
+	if len(p.order) != 6 {
+		t.Fatalf("order %v, want the 6 opaque colours that pair up", p.order)
+	}
+	rng := newKeyStream([]byte("bits"))
+	for _, off := range p.cells {
+		bit := rng.Intn(2)
+		p.setBit(off, bit, rng)
+		if p.getBit(off) != bit {
+			t.Fatalf("pixel %d: wrote %d, read %d", off, bit, p.getBit(off))
+		}
+	}
+	for i, v := range before {
+		transparent := v == 7
+		if transparent != (img.Pix[i] == 7) {
+			t.Fatalf("pixel %d went from index %d to %d", i, v, img.Pix[i])
+		}
+		// The unpaired seventh colour carries nothing either
+		if p.rank[v] < 0 && img.Pix[i] != v {
+			t.Fatalf("unused colour %d at pixel %d changed", v, i)
+		}
+	}
+}
+
+func TestPaletteCovers(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+	plan9 := noisyPaletted(320, 240, palette.Plan9, 2)
+	small := noisyPaletted(320, 240, smallPalette(20), 3)
+
+	for _, cover := range []struct {
+		name string
+		img  *image.Paletted
+	}{
+		{"plan9.png", plan9}, {"plan9.gif", plan9}, {"small.png", small}, {"small.gif", small},
+	} {
+		t.Run(cover.name, func(t *testing.T) {
+			in := filepath.Join(t.TempDir(), cover.name)
+			out := strings.TrimSuffix(in, filepath.Ext(in)) + "-out" + filepath.Ext(in)
+			writeFile(t, in, encodeWith(t, func(b *bytes.Buffer) error {
+				if filepath.Ext(in) == ".gif" {
+					return gif.Encode(b, cover.img, nil)
+				}
+				return png.Encode(b, cover.img)
+			}))
+
+			mustRun(t, nil, "hide", "-k", pub, "-i", in, "-o", out, "-t", "indexed "+cover.name)
+			if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "indexed "+cover.name) {
+				t.Errorf("reveal printed:\n%s", got)
+			}
+
+			// The palette isn't touched, so the file keeps its size
+			if got, want := decodedPalette(t, out), decodedPalette(t, in); len(got) != len(want) {
+				t.Errorf("palette of %d colours became %d", len(want), len(got))
+			} else {
+				for i := range want {
+					if got[i] != want[i] {
+						t.Fatalf("palette entry %d changed from %v to %v", i, want[i], got[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func decodedPalette(t *testing.T, path string) color.Palette {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paletted, ok := img.(*image.Paletted)
+	if !ok {
+		t.Fatalf("%s decoded as %T", path, img)
+	}
+	return paletted.Palette
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// PasswordEnv lets scripts supply the password. It is never taken from argv,
+// where other users could read it from the process list.
+const PasswordEnv = "IMGCRYPT_PASSWORD"
+
+// ReadPassword takes the password from PasswordEnv, or prompts on the
+// terminal with echo off. With confirm set it asks twice.
+func ReadPassword(confirm bool) ([]byte, error) {
+	if env, ok := os.LookupEnv(PasswordEnv); ok {
+		if env == "" {
+			return nil, fmt.Errorf("%s is set but empty", PasswordEnv)
+		}
+		return []byte(env), nil
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to prompt on; set %s instead", PasswordEnv)
+	}
+	defer tty.Close()
+
+	password, err := promptNoEcho(tty, "Password: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(password) == 0 {
+		return nil, errors.New("empty password")
+	}
+
+	if confirm {
+		again, err := promptNoEcho(tty, "Repeat password: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(password, again) {
+			return nil, errors.New("passwords do not match")
+		}
+	}
+	return password, nil
+}
+
+func promptNoEcho(tty *os.File, prompt string) ([]byte, error) {
+	fmt.Fprint(tty, prompt)
+	defer fmt.Fprintln(tty)
+
+	restore, err := disableEcho(tty)
+	if err != nil {
+		return nil, fmt.Errorf("could not turn off terminal echo: %v", err)
+	}
+	defer restore()
+
+	line, err := bufio.NewReader(tty).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const payloadVersion = 2
+
+// Compression of the payload data, recorded in the container
+const (
+	CompressionNone    = 0
+	CompressionDeflate = 1
+)
+
+// DefaultMaxPayloadSize bounds the decompressed data reveal accepts, so a
+// small crafted body can't inflate into gigabytes.
+const DefaultMaxPayloadSize = 256 << 20
+
+// Payload is the inner container that gets encrypted into the body. It keeps
+// enough of the original file around to write it back byte for byte.
+type Payload struct {
+	Name        string // Base name of the hidden file, empty for -t text
+	Mode        os.FileMode
+	ModTime     time.Time
+	ContentType string
+	Data        []byte
+}
+
+// NewTextPayload wraps text given on the command line.
+func NewTextPayload(text string) *Payload {
+	return &Payload{
+		Mode:        0644,
+		ModTime:     time.Now(),
+		ContentType: "text/plain; charset=utf-8",
+		Data:        []byte(text),
+	}
+}
+
+// NewFilePayload reads path and records its name, mode bits, modification
+// time and content type.
+func NewFilePayload(path string) (*Payload, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	return &Payload{
+		Name:        filepath.Base(path),
+		Mode:        info.Mode().Perm(),
+		ModTime:     info.ModTime(),
+		ContentType: contentType,
+		Data:        data,
+	}, nil
+}
+
+// IsText reports whether the payload is safe to print to a terminal.
+func (p *Payload) IsText() bool {
+	return strings.HasPrefix(p.ContentType, "text/")
+}
+
+// compressData deflates data, and keeps it as it is unless that saves space.
+func compressData(data []byte) (uint8, []byte) {
+	buf := new(bytes.Buffer)
+	w, _ := flate.NewWriter(buf, flate.BestCompression)
+	w.Write(data)
+	w.Close()
+	if buf.Len() >= len(data) {
+		return CompressionNone, data
+	}
+	return CompressionDeflate, buf.Bytes()
+}
+
+// decompressData undoes compressData. It fails unless stored comes out as
+// exactly size bytes, and never inflates past that.
+func decompressData(compression uint8, stored []byte, size uint64) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		if size != uint64(len(stored)) {
+			return nil, fmt.Errorf("payload size %d does not match %d bytes of data", size, len(stored))
+		}
+		return stored, nil
+	case CompressionDeflate:
+		r := flate.NewReader(bytes.NewReader(stored))
+		defer r.Close()
+		data, err := io.ReadAll(io.LimitReader(r, int64(size)+1))
+		if err != nil {
+			return nil, fmt.Errorf("bad compressed payload: %v", err)
+		}
+		if uint64(len(data)) != size {
+			return nil, fmt.Errorf("compressed payload does not inflate to its recorded %d bytes", size)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unsupported payload compression %d", compression)
+}
+
+// Overhead is how much the container adds around the data when it is stored
+// uncompressed.
+func (p *Payload) Overhead() int {
+	empty := *p
+	empty.Data = nil
+	packed, _ := empty.MarshalBinary()
+	return len(packed)
+}
+
+// Layout (little endian): version u8, compression u8, name len u16 + name,
+// mode u32, mtime unix nanos i64, content type len u16 + type, data len u64
+// (before compression) + data. The data is deflated when that shrinks it.
+func (p *Payload) MarshalBinary() ([]byte, error) {
+	if len(p.Name) > 0xffff || len(p.ContentType) > 0xffff {
+		return nil, errors.New("payload metadata too long")
+	}
+	compression, stored := compressData(p.Data)
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(payloadVersion)
+	buf.WriteByte(compression)
+	binary.Write(buf, binary.LittleEndian, uint16(len(p.Name)))
+	buf.WriteString(p.Name)
+	binary.Write(buf, binary.LittleEndian, uint32(p.Mode.Perm()))
+	binary.Write(buf, binary.LittleEndian, p.ModTime.UnixNano())
+	binary.Write(buf, binary.LittleEndian, uint16(len(p.ContentType)))
+	buf.WriteString(p.ContentType)
+	binary.Write(buf, binary.LittleEndian, uint64(len(p.Data)))
+	buf.Write(stored)
+	return buf.Bytes(), nil
+}
+
+func (p *Payload) UnmarshalBinary(data []byte) error {
+	return p.UnmarshalBinaryLimit(data, DefaultMaxPayloadSize)
+}
+
+// UnmarshalBinaryLimit rejects compressed data that would inflate past
+// maxSize bytes.
+func (p *Payload) UnmarshalBinaryLimit(data []byte, maxSize int64) error {
+	r := bytes.NewReader(data)
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != payloadVersion {
+		return fmt.Errorf("unsupported payload version %d", version)
+	}
+	compression, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	name, err := readString16(r)
+	if err != nil {
+		return fmt.Errorf("bad payload name: %v", err)
+	}
+
+	var mode uint32
+	var mtime int64
+	if err := binary.Read(r, binary.LittleEndian, &mode); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &mtime); err != nil {
+		return err
+	}
+
+	contentType, err := readString16(r)
+	if err != nil {
+		return fmt.Errorf("bad payload content type: %v", err)
+	}
+
+	var size uint64
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if compression != CompressionNone && size > uint64(maxSize) {
+		return fmt.Errorf("payload would decompress to %d bytes, over the %d byte limit", size, maxSize)
+	}
+	stored := data[len(data)-r.Len():]
+	payloadData, err := decompressData(compression, stored, size)
+	if err != nil {
+		return err
+	}
+
+	p.Name = name
+	p.Mode = os.FileMode(mode).Perm()
+	p.ModTime = time.Unix(0, mtime)
+	p.ContentType = contentType
+	p.Data = payloadData
+	return nil
+}
+
+func readString16(r *bytes.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	s := make([]byte, n)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// SafeName is the stored name reduced to a plain file name, so a crafted
+// image can't write outside the directory given to -outdir.
+func (p *Payload) SafeName() string {
+	name := filepath.Base(filepath.Clean("/" + p.Name))
+	if name == "/" || name == "." || name == "" {
+		return "revealed.bin"
+	}
+	return name
+}
+
+// WriteFile writes the data to path with the stored mode and modification
+// time. "-" writes the raw bytes to stdout. Existing files are kept unless
+// force is set.
+func (p *Payload) WriteFile(path string, force bool) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(p.Data)
+		return err
+	}
+
+	if !force {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists (use -f to overwrite)", path)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".imgcrypt-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(p.Data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	perm := p.Mode.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), p.ModTime, p.ModTime); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	p := &Payload{Name: "notes.txt", Mode: 0600, ModTime: time.Unix(1700000000, 5), ContentType: "text/plain", Data: []byte("short")}
+	packed, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Payload
+	if err := got.UnmarshalBinary(packed); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != p.Name || got.Mode != p.Mode || !got.ModTime.Equal(p.ModTime) ||
+		got.ContentType != p.ContentType || !bytes.Equal(got.Data, p.Data) {
+		t.Errorf("got %+v, want %+v", got, p)
+	}
+	if len(packed) != p.Overhead()+len(p.Data) {
+		t.Errorf("packed %d bytes, overhead %d plus %d of data", len(packed), p.Overhead(), len(p.Data))
+	}
+
+	for i := range packed {
+		if err := got.UnmarshalBinary(packed[:i]); err == nil {
+			t.Fatalf("truncated to %d bytes and accepted", i)
+		}
+	}
+}
+
+func TestPayloadSafeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"report.pdf":         "report.pdf",
+		"../../etc/passwd":   "passwd",
+		"/abs/path/key.pem":  "key.pem",
+		"..":                 "revealed.bin",
+		"":                   "revealed.bin",
+		"dir/":               "dir",
+		"a/../../../b/c.txt": "c.txt",
+	} {
+		p := Payload{Name: name}
+		if got := p.SafeName(); got != want {
+			t.Errorf("SafeName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestPayloadCompression(t *testing.T) {
+	text := NewTextPayload(strings.Repeat("compresses well ", 200))
+	random := NewTextPayload("")
+	random.Data = make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(random.Data)
+
+	for _, tt := range []struct {
+		name       string
+		p          *Payload
+		compressed bool
+	}{
+		{"text", text, true},
+		{"random", random, false},
+	} {
+		packed, err := tt.p.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := len(packed) - tt.p.Overhead()
+		if tt.compressed && stored >= len(tt.p.Data)/4 {
+			t.Errorf("%s: %d bytes stored as %d", tt.name, len(tt.p.Data), stored)
+		}
+		// Data DEFLATE can't shrink is stored as is, never larger
+		if !tt.compressed && stored != len(tt.p.Data) {
+			t.Errorf("%s: %d bytes stored as %d", tt.name, len(tt.p.Data), stored)
+		}
+
+		var got Payload
+		if err := got.UnmarshalBinary(packed); err != nil || !bytes.Equal(got.Data, tt.p.Data) {
+			t.Errorf("%s: unpacked %d bytes, %v", tt.name, len(got.Data), err)
+		}
+	}
+}
+
+// A small payload can't claim to inflate past the limit
+func TestPayloadSizeLimit(t *testing.T) {
+	p := NewTextPayload(strings.Repeat("z", 10000))
+	packed, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packed) > 1000 {
+		t.Fatalf("10000 repeated bytes packed to %d", len(packed))
+	}
+	var got Payload
+	if err := got.UnmarshalBinaryLimit(packed, 9999); err == nil {
+		t.Error("payload over the limit accepted")
+	}
+	if err := got.UnmarshalBinaryLimit(packed, 10000); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+)
+
+// PNG colour types, as stored in IHDR
+const (
+	pngGray           = 0
+	pngTruecolor      = 2
+	pngPaletted       = 3
+	pngGrayAlpha      = 4
+	pngTruecolorAlpha = 6
+)
+
+// Row filter types
+const (
+	pngFilterNone = iota
+	pngFilterSub
+	pngFilterUp
+	pngFilterAverage
+	pngFilterPaeth
+)
+
+// adam7 lists the interlace passes as x0, y0, dx, dy.
+var adam7 = [][4]int{
+	{0, 0, 8, 8}, {4, 0, 8, 8}, {0, 4, 4, 8}, {2, 0, 4, 4},
+	{0, 2, 2, 4}, {1, 0, 2, 2}, {0, 1, 1, 2},
+}
+
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// pngFormat writes an image back as the PNG it was read from. IHDR and every
+// other chunk are copied through in their original order; only the image
+// data is filtered and compressed again, with the same colour type, bit
+// depth and interlacing.
+type pngFormat struct {
+	width      int
+	height     int
+	depth      int // Bits per sample
+	colorType  int
+	interlaced bool
+
+	chunks   []pngChunk // Every chunk but IDAT
+	idatAt   int        // Index in chunks the IDAT run came before
+	idatSize int        // Size of the first IDAT chunk, reused when splitting
+	trailer  []byte     // Anything after IEND
+
+	// layout holds the unfiltered samples in plain row order. 16-bit
+	// samples are edited through their low byte; high lays out their high
+	// byte, which is left alone, and is nil at 8 bits.
+	layout *rawFormat
+	high   *rawFormat
+}
+
+func (f *pngFormat) ext() string    { return ".png" }
+func (f *pngFormat) hasAlpha() bool { return f.layout.hasAlpha() }
+func (f *pngFormat) isGray() bool   { return f.layout.isGray() }
+
+// samplesPerPixel is the number of samples the colour type stores per pixel.
+func (f *pngFormat) samplesPerPixel() int {
+	switch f.colorType {
+	case pngTruecolor:
+		return 3
+	case pngGrayAlpha:
+		return 2
+	case pngTruecolorAlpha:
+		return 4
+	}
+	return 1
+}
+
+// bytesPerPixel is the filter unit, at least one byte.
+func (f *pngFormat) bytesPerPixel() int {
+	return max(f.samplesPerPixel()*f.depth/8, 1)
+}
+
+// parsePNG splits data into chunks and reads IHDR. The compressed image
+// data comes back separately.
+func parsePNG(data []byte) (*pngFormat, []byte, error) {
+	if !bytes.HasPrefix(data, pngMagic) {
+		return nil, nil, errors.New("png: not a PNG file")
+	}
+
+	f := &pngFormat{idatAt: -1}
+	var idat []byte
+	pos := len(pngMagic)
+	for {
+		if pos+12 > len(data) {
+			return nil, nil, errors.New("png: truncated chunk")
+		}
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		if n > len(data)-pos-12 {
+			return nil, nil, errors.New("png: chunk runs past the end of the file")
+		}
+		typ := string(data[pos+4 : pos+8])
+		body := data[pos+8 : pos+8+n]
+		if crc32.ChecksumIEEE(data[pos+4:pos+8+n]) != binary.BigEndian.Uint32(data[pos+8+n:]) {
+			return nil, nil, fmt.Errorf("png: bad checksum in %s chunk", typ)
+		}
+		pos += 12 + n
+
+		if typ == "IDAT" {
+			if f.idatAt < 0 {
+				f.idatAt, f.idatSize = len(f.chunks), n
+			}
+			idat = append(idat, body...)
+			continue
+		}
+		f.chunks = append(f.chunks, pngChunk{typ: typ, data: body})
+		if typ == "IEND" {
+			break
+		}
+	}
+	f.trailer = data[pos:]
+
+	if f.chunks[0].typ != "IHDR" || len(f.chunks[0].data) != 13 {
+		return nil, nil, errors.New("png: missing IHDR")
+	}
+	if f.idatAt < 0 {
+		return nil, nil, errors.New("png: no image data")
+	}
+	ihdr := f.chunks[0].data
+	f.width = int(binary.BigEndian.Uint32(ihdr[0:]))
+	f.height = int(binary.BigEndian.Uint32(ihdr[4:]))
+	f.depth, f.colorType = int(ihdr[8]), int(ihdr[9])
+	f.interlaced = ihdr[12] == 1
+	return f, idat, nil
+}
+
+// preservable reports whether we can edit the samples and write the file
+// back as it was: 8 or 16-bit gray or truecolour, with or without alpha.
+// Packed gray and tRNS colour keys are not. 8-bit palettes go through
+// palettedImage instead.
+func (f *pngFormat) preservable() bool {
+	if f.depth != 8 && f.depth != 16 {
+		return false
+	}
+	switch f.colorType {
+	case pngGray, pngGrayAlpha, pngTruecolor, pngTruecolorAlpha:
+	default:
+		return false
+	}
+	for _, c := range f.chunks {
+		if c.typ == "tRNS" {
+			return false
+		}
+	}
+	return true
+}
+
+// passes is the interlace passes, or a single pass over the whole image.
+func (f *pngFormat) passes() [][4]int {
+	if f.interlaced {
+		return adam7
+	}
+	return [][4]int{{0, 0, 1, 1}}
+}
+
+// maxDeflateRatio bounds how far DEFLATE can expand its input: 258 bytes
+// from a match coded in as little as two bits, plus block overhead.
+const maxDeflateRatio = 1032
+
+// inflate decompresses and unfilters idat into samples in plain row order,
+// undoing the interlacing if there is any.
+func (f *pngFormat) inflate(idat []byte) ([]byte, error) {
+	if f.width <= 0 || f.height <= 0 {
+		return nil, errors.New("png: bad image dimensions")
+	}
+	bpp := f.bytesPerPixel()
+	if int64(f.width)*int64(f.height)*int64(bpp) > 1<<31 {
+		return nil, errors.New("png: image too large")
+	}
+	// DEFLATE expands data at most about 1032 times, so a size idat can't
+	// hold is refused before anything is allocated for it. Interlacing only
+	// adds filter bytes.
+	if int64(f.height)*(1+int64(f.width)*int64(bpp)) > maxDeflateRatio*int64(len(idat)) {
+		return nil, errors.New("png: image data too short for the image size")
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(idat))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	stride := f.width * bpp
+	samples := make([]byte, f.height*stride)
+	for _, pass := range f.passes() {
+		x0, y0, dx, dy := pass[0], pass[1], pass[2], pass[3]
+		pw, ph := (f.width-x0+dx-1)/dx, (f.height-y0+dy-1)/dy
+		if pw <= 0 || ph <= 0 {
+			continue
+		}
+
+		// Each row is a filter byte and the filtered pixels
+		cur, prev := make([]byte, 1+pw*bpp), make([]byte, 1+pw*bpp)
+		for py := 0; py < ph; py++ {
+			if _, err := io.ReadFull(zr, cur); err != nil {
+				return nil, fmt.Errorf("png: reading image data: %v", err)
+			}
+			if err := unfilterRow(cur[0], cur[1:], prev[1:], bpp); err != nil {
+				return nil, err
+			}
+			row := (y0 + py*dy) * stride
+			for px := 0; px < pw; px++ {
+				copy(samples[row+(x0+px*dx)*bpp:], cur[1+px*bpp:1+(px+1)*bpp])
+			}
+			prev, cur = cur, prev
+		}
+	}
+	return samples, nil
+}
+
+// decode inflates idat into layout.
+func (f *pngFormat) decode(idat []byte) error {
+	samples, err := f.inflate(idat)
+	if err != nil {
+		return err
+	}
+
+	// Edit the low byte of every sample
+	size := f.depth / 8
+	lo := func(sample int) int { return sample*size + size - 1 }
+	f.layout = &rawFormat{
+		extension: ".png",
+		raw:       samples,
+		width:     f.width,
+		height:    f.height,
+		rowOffset: make([]int, f.height),
+		pixelSize: f.bytesPerPixel(),
+	}
+	for y := range f.layout.rowOffset {
+		f.layout.rowOffset[y] = y * f.width * f.bytesPerPixel()
+	}
+	switch f.colorType {
+	case pngGray:
+		f.layout.channels, f.layout.gray = [4]int{lo(0), -1, -1, -1}, true
+	case pngGrayAlpha:
+		f.layout.channels, f.layout.gray = [4]int{lo(0), -1, -1, lo(1)}, true
+	case pngTruecolor:
+		f.layout.channels = [4]int{lo(0), lo(1), lo(2), -1}
+	case pngTruecolorAlpha:
+		f.layout.channels = [4]int{lo(0), lo(1), lo(2), lo(3)}
+	}
+	if size == 2 {
+		high := *f.layout
+		for c, pos := range high.channels {
+			if pos >= 0 {
+				high.channels[c] = pos - 1
+			}
+		}
+		f.high = &high
+	}
+	return f.layout.check()
+}
+
+// highBytes is the image as its high bytes, for 16-bit samples only.
+func (f *pngFormat) highBytes() *image.NRGBA {
+	if f.high == nil {
+		return nil
+	}
+	return f.high.image()
+}
+
+// palettedImage reads an 8-bit palette image, with the alphas from tRNS.
+func (f *pngFormat) palettedImage(idat []byte) (*image.Paletted, error) {
+	samples, err := f.inflate(idat)
+	if err != nil {
+		return nil, err
+	}
+
+	var palette color.Palette
+	var alphas []byte
+	for _, c := range f.chunks {
+		switch c.typ {
+		case "PLTE":
+			if len(c.data) == 0 || len(c.data)%3 != 0 || len(c.data) > 3*256 {
+				return nil, errors.New("png: bad palette")
+			}
+			for i := 0; i < len(c.data); i += 3 {
+				palette = append(palette, color.NRGBA{c.data[i], c.data[i+1], c.data[i+2], 0xff})
+			}
+		case "tRNS":
+			alphas = c.data
+		}
+	}
+	if palette == nil {
+		return nil, errors.New("png: missing palette")
+	}
+	for i, a := range alphas[:min(len(alphas), len(palette))] {
+		entry := palette[i].(color.NRGBA)
+		entry.A = a
+		palette[i] = entry
+	}
+
+	return &image.Paletted{
+		Pix:     samples,
+		Stride:  f.width,
+		Rect:    image.Rect(0, 0, f.width, f.height),
+		Palette: palette,
+	}, nil
+}
+
+func unfilterRow(filter byte, cur, prev []byte, bpp int) error {
+	switch filter {
+	case pngFilterNone:
+	case pngFilterSub:
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case pngFilterUp:
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case pngFilterAverage:
+		for i := range cur {
+			var left int
+			if i >= bpp {
+				left = int(cur[i-bpp])
+			}
+			cur[i] += byte((left + int(prev[i])) / 2)
+		}
+	case pngFilterPaeth:
+		for i := range cur {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = cur[i-bpp], prev[i-bpp]
+			}
+			cur[i] += paeth(left, prev[i], upLeft)
+		}
+	default:
+		return fmt.Errorf("png: bad filter type %d", filter)
+	}
+	return nil
+}
+
+// filterRow writes row filtered with filter into dst.
+func filterRow(filter byte, dst, row, prev []byte, bpp int) {
+	for i := range row {
+		var left, upLeft byte
+		if i >= bpp {
+			left, upLeft = row[i-bpp], prev[i-bpp]
+		}
+		switch filter {
+		case pngFilterNone:
+			dst[i] = row[i]
+		case pngFilterSub:
+			dst[i] = row[i] - left
+		case pngFilterUp:
+			dst[i] = row[i] - prev[i]
+		case pngFilterAverage:
+			dst[i] = row[i] - byte((int(left)+int(prev[i]))/2)
+		case pngFilterPaeth:
+			dst[i] = row[i] - paeth(left, prev[i], upLeft)
+		}
+	}
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// compress filters and deflates samples. Each row gets the filter with the
+// smallest sum of absolute differences, the usual heuristic.
+func (f *pngFormat) compress(samples []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+
+	bpp := f.bytesPerPixel()
+	stride := f.width * bpp
+	for _, pass := range f.passes() {
+		x0, y0, dx, dy := pass[0], pass[1], pass[2], pass[3]
+		pw, ph := (f.width-x0+dx-1)/dx, (f.height-y0+dy-1)/dy
+		if pw <= 0 || ph <= 0 {
+			continue
+		}
+
+		prev := make([]byte, pw*bpp)
+		row := make([]byte, pw*bpp)
+		best, try := make([]byte, 1+pw*bpp), make([]byte, pw*bpp)
+		for py := 0; py < ph; py++ {
+			y := y0 + py*dy
+			for px := 0; px < pw; px++ {
+				at := y*stride + (x0+px*dx)*bpp
+				copy(row[px*bpp:(px+1)*bpp], samples[at:at+bpp])
+			}
+
+			bestCost := -1
+			for filter := byte(pngFilterNone); filter <= pngFilterPaeth; filter++ {
+				filterRow(filter, try, row, prev, bpp)
+				cost := 0
+				for _, b := range try {
+					cost += abs(int(int8(b)))
+				}
+				if bestCost < 0 || cost < bestCost {
+					bestCost = cost
+					best[0] = filter
+					copy(best[1:], try)
+				}
+			}
+			if _, err := zw.Write(best); err != nil {
+				return nil, err
+			}
+			prev, row = row, prev
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writePNGChunk(w *bytes.Buffer, typ string, data []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	w.Write(n[:])
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	w.WriteString(typ)
+	w.Write(data)
+	binary.BigEndian.PutUint32(n[:], crc.Sum32())
+	w.Write(n[:])
+}
+
+func (f *pngFormat) encode(w io.Writer, img *image.NRGBA) error {
+	return f.write(w, f.layout.patch(img))
+}
+
+// encodePaletted writes the indices of an 8-bit palette image.
+func (f *pngFormat) encodePaletted(w io.Writer, img *image.Paletted) error {
+	return f.write(w, img.Pix)
+}
+
+// write puts samples in place of the original image data.
+func (f *pngFormat) write(w io.Writer, samples []byte) error {
+	idat, err := f.compress(samples)
+	if err != nil {
+		return err
+	}
+	split := f.idatSize
+	if split <= 0 {
+		split = 1 << 15
+	}
+
+	var buf bytes.Buffer
+	buf.Write(pngMagic)
+	for i, c := range f.chunks {
+		if i == f.idatAt {
+			for len(idat) > 0 {
+				n := min(len(idat), split)
+				writePNGChunk(&buf, "IDAT", idat[:n])
+				idat = idat[n:]
+			}
+		}
+		writePNGChunk(&buf, c.typ, c.data)
+	}
+	buf.Write(f.trailer)
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// craftPNG builds an 8-bit truecolour PNG whose IHDR claims w x h around
+// the given, possibly too short, row data.
+func craftPNG(w, h int, rows []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(pngMagic)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(w))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(h))
+	ihdr[8], ihdr[9] = 8, pngTruecolor
+	writePNGChunk(&buf, "IHDR", ihdr)
+
+	var idat bytes.Buffer
+	zw := zlib.NewWriter(&idat)
+	zw.Write(rows)
+	zw.Close()
+	writePNGChunk(&buf, "IDAT", idat.Bytes())
+	writePNGChunk(&buf, "IEND", nil)
+	return buf.Bytes()
+}
+
+func TestPNGSizeBoundedByData(t *testing.T) {
+	dir := t.TempDir()
+	bomb := filepath.Join(dir, "bomb.png")
+	writeFile(t, bomb, craftPNG(23000, 23000, make([]byte, 16)))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := LoadCarrier(bomb); err == nil {
+		t.Fatal("23000x23000 PNG with 16 bytes of data accepted")
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("allocated %d bytes for a %d-byte file", alloc, len(craftPNG(23000, 23000, make([]byte, 16))))
+	}
+
+	// Enough compressed data to be plausible, but a row short
+	rows := make([]byte, 100*(1+3*100)-1)
+	rand.New(rand.NewSource(1)).Read(rows)
+	for y := 0; y < 100; y++ {
+		rows[y*(1+3*100)] = pngFilterNone
+	}
+	short := filepath.Join(dir, "short.png")
+	writeFile(t, short, craftPNG(100, 100, rows))
+	if _, err := LoadCarrier(short); err == nil {
+		t.Error("PNG with a short image data stream accepted")
+	}
+
+	// Flat images compress far, and still load
+	flat := filepath.Join(dir, "flat.png")
+	writeTestPNG(t, flat, image.NewGray(image.Rect(0, 0, 2000, 2000)))
+	if _, err := LoadCarrier(flat); err != nil {
+		t.Errorf("flat PNG: %v", err)
+	}
+}
+
+// pngChunkTypes lists the chunks of a PNG file, IDAT runs as one.
+func pngChunkTypes(t *testing.T, path string) (*pngFormat, []string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, err := parsePNG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for i, c := range f.chunks {
+		if i == f.idatAt {
+			types = append(types, "IDAT")
+		}
+		types = append(types, c.typ)
+	}
+	return f, types
+}
+
+func TestPNGKeepsFormatAndChunks(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := keyPair(t, dir, "bob")
+
+	rgba := noisyRGBA(120, 100, 14)
+	gray := image.NewGray(rgba.Bounds())
+	gray16 := image.NewGray16(rgba.Bounds())
+	wide := image.NewNRGBA64(rgba.Bounds())
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 120; x++ {
+			c := rgba.NRGBAAt(x, y)
+			gray.SetGray(x, y, color.Gray{c.R})
+			gray16.SetGray16(x, y, color.Gray16{uint16(c.R)<<8 | uint16(c.G)})
+			wide.SetNRGBA64(x, y, color.NRGBA64{uint16(c.R)<<8 | uint16(c.G), uint16(c.B) << 8, uint16(c.G) << 8, 0x8000})
+		}
+	}
+
+	for _, cover := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"rgb.png", rgba}, {"gray.png", gray}, {"gray16.png", gray16}, {"rgba16.png", wide},
+	} {
+		t.Run(cover.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, cover.img); err != nil {
+				t.Fatal(err)
+			}
+			// A text chunk after IHDR, which has to come through untouched
+			var text bytes.Buffer
+			writePNGChunk(&text, "tEXt", []byte("Comment\x00kept as is"))
+			ihdrEnd := len(pngMagic) + 12 + 13
+			data := slices.Concat(buf.Bytes()[:ihdrEnd], text.Bytes(), buf.Bytes()[ihdrEnd:])
+
+			in, out := filepath.Join(t.TempDir(), cover.name), filepath.Join(t.TempDir(), "out.png")
+			writeFile(t, in, data)
+			mustRun(t, nil, "hide", "-k", pub, "-i", in, "-o", out, "-t", "kept "+cover.name)
+			if got := mustRun(t, nil, "reveal", "-k", priv, "-i", out, "-text"); !strings.Contains(got, "kept "+cover.name) {
+				t.Errorf("reveal printed:\n%s", got)
+			}
+
+			before, beforeTypes := pngChunkTypes(t, in)
+			after, afterTypes := pngChunkTypes(t, out)
+			if after.colorType != before.colorType || after.depth != before.depth {
+				t.Errorf("colour type %d depth %d became %d depth %d", before.colorType, before.depth, after.colorType, after.depth)
+			}
+			if !slices.Equal(beforeTypes, afterTypes) {
+				t.Errorf("chunks %v became %v", beforeTypes, afterTypes)
+			}
+			for _, c := range after.chunks {
+				if c.typ == "tEXt" && string(c.data) != "Comment\x00kept as is" {
+					t.Errorf("tEXt became %q", c.data)
+				}
+			}
+		})
+	}
+}
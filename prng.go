@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+)
+
+// keyStream is a deterministic CSPRNG: AES-256 in counter mode over an
+// all-zero block, keyed by SHA-256 of the seed. Everything here is our own
+// code, so a given seed yields the same stream on every Go release.
+type keyStream struct {
+	roundKeys [][]byte
+	counter   [16]byte
+	buf       []byte
+}
+
+func newKeyStream(seed []byte) *keyStream {
+	key := sha256.Sum256(seed)
+	roundKeys, _ := keyExpansion(key[:]) // 32 bytes is always a valid size
+	return &keyStream{roundKeys: roundKeys}
+}
+
+func (k *keyStream) Read(p []byte) (int, error) {
+	for i := range p {
+		if len(k.buf) == 0 {
+			k.buf = encryptBlockExpanded(k.counter[:], k.roundKeys)
+			for j := len(k.counter) - 1; j >= 0; j-- {
+				k.counter[j]++
+				if k.counter[j] != 0 {
+					break
+				}
+			}
+		}
+		p[i] = k.buf[0]
+		k.buf = k.buf[1:]
+	}
+	return len(p), nil
+}
+
+func (k *keyStream) Uint64() uint64 {
+	var b [8]byte
+	k.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// Intn returns a uniform value in [0, n). Draws from the top of the range
+// that would wrap unevenly are rejected, so there is no modulo bias.
+func (k *keyStream) Intn(n int) int {
+	if n <= 0 {
+		panic("keyStream.Intn: n must be positive")
+	}
+	max := uint64(n)
+	rem := (math.MaxUint64%max + 1) % max
+	for {
+		v := k.Uint64()
+		if v <= math.MaxUint64-rem {
+			return int(v % max)
+		}
+	}
+}
+
+// shuffledPrefix runs the first count steps of a Fisher–Yates shuffle over
+// 0..n-1 and returns those count entries.
+func (k *keyStream) shuffledPrefix(n, count int) []int {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	for i := 0; i < count; i++ {
+		j := i + k.Intn(n-i)
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+	return perm[:count]
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+	"os"
+)
+
+// rawFormat is a file whose pixels are stored uncompressed at 8 bits per
+// sample (BMP, baseline TIFF). Encoding copies the original bytes and writes
+// the samples back in place, so headers, metadata and row padding come out
+// exactly as they went in.
+type rawFormat struct {
+	extension string
+	raw       []byte
+	width     int
+	height    int
+	rowOffset []int  // File offset of each row's first pixel, top to bottom
+	pixelSize int    // Bytes per pixel
+	channels  [4]int // Byte of R, G, B and A within a pixel; -1 if not stored
+	gray      bool   // Only R is stored; G and B mirror it
+}
+
+func (f *rawFormat) ext() string    { return f.extension }
+func (f *rawFormat) hasAlpha() bool { return f.channels[3] >= 0 }
+func (f *rawFormat) isGray() bool   { return f.gray }
+
+// check makes sure every pixel the layout points at is inside the file.
+func (f *rawFormat) check() error {
+	if f.width <= 0 || f.height <= 0 || len(f.rowOffset) != f.height {
+		return errors.New("bad image dimensions")
+	}
+	for _, off := range f.rowOffset {
+		if off < 0 || off+f.width*f.pixelSize > len(f.raw) {
+			return errors.New("pixel data runs past the end of the file")
+		}
+	}
+	return nil
+}
+
+// image reads the pixels out of raw. Channels that are not stored come out
+// opaque, or as copies of R for gray.
+func (f *rawFormat) image() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, f.width, f.height))
+	for y, off := range f.rowOffset {
+		for x := 0; x < f.width; x++ {
+			src := f.raw[off+x*f.pixelSize:]
+			dst := img.Pix[img.PixOffset(x, y):]
+			dst[3] = 255
+			for c, pos := range f.channels {
+				if pos >= 0 {
+					dst[c] = src[pos]
+				}
+			}
+			if f.gray {
+				dst[1], dst[2] = dst[0], dst[0]
+			}
+		}
+	}
+	return img
+}
+
+// patch returns a copy of raw with the pixels of img written back.
+func (f *rawFormat) patch(img *image.NRGBA) []byte {
+	out := append([]byte(nil), f.raw...)
+	for y, off := range f.rowOffset {
+		for x := 0; x < f.width; x++ {
+			src := img.Pix[img.PixOffset(x, y):]
+			dst := out[off+x*f.pixelSize:]
+			for c, pos := range f.channels {
+				if pos >= 0 {
+					dst[pos] = src[c]
+				}
+			}
+		}
+	}
+	return out
+}
+
+func (f *rawFormat) encode(w io.Writer, img *image.NRGBA) error {
+	_, err := w.Write(f.patch(img))
+	return err
+}
+
+// loadRawImage reads filename and lays its pixels out with parse.
+func loadRawImage(filename string, parse func([]byte) (*rawFormat, error)) (*EditableImage, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return &EditableImage{Img: f.image(), format: f}, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import "errors"
+
+// Reed–Solomon over GF(2^8) with the 0x11d polynomial and generator 2, the
+// usual choice (QR codes, CDs). A codeword of up to 255 bytes with nsym
+// parity bytes corrects e errors and f erasures as long as 2e + f <= nsym.
+// Polynomials are byte slices, highest degree first.
+
+var errTooManyErrors = errors.New("too many errors to correct")
+
+var gfExp, gfLog = func() (exp [512]byte, log [256]int) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	// Doubled so products of two logs need no reduction
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[a]+255-gfLog[b])%255]
+}
+
+// gfPow2 is 2^e for any e, negative included.
+func gfPow2(e int) byte {
+	return gfExp[(e%255+255)%255]
+}
+
+func gfPolyScale(p []byte, x byte) []byte {
+	out := make([]byte, len(p))
+	for i, c := range p {
+		out[i] = gfMul(c, x)
+	}
+	return out
+}
+
+func gfPolyAdd(p, q []byte) []byte {
+	out := make([]byte, max(len(p), len(q)))
+	copy(out[len(out)-len(p):], p)
+	for i, c := range q {
+		out[len(out)-len(q)+i] ^= c
+	}
+	return out
+}
+
+func gfPolyMul(p, q []byte) []byte {
+	out := make([]byte, len(p)+len(q)-1)
+	for i, a := range p {
+		for j, b := range q {
+			out[i+j] ^= gfMul(a, b)
+		}
+	}
+	return out
+}
+
+func gfPolyEval(p []byte, x byte) byte {
+	y := p[0]
+	for _, c := range p[1:] {
+		y = gfMul(y, x) ^ c
+	}
+	return y
+}
+
+// rsGenerator is (x - 2^0)(x - 2^1)...(x - 2^(nsym-1)).
+func rsGenerator(nsym int) []byte {
+	g := []byte{1}
+	for i := 0; i < nsym; i++ {
+		g = gfPolyMul(g, []byte{1, gfPow2(i)})
+	}
+	return g
+}
+
+// rsEncode returns the nsym parity bytes of msg.
+func rsEncode(msg []byte, nsym int) []byte {
+	gen := rsGenerator(nsym)
+	rem := make([]byte, len(msg)+nsym)
+	copy(rem, msg)
+	for i := range msg {
+		if coef := rem[i]; coef != 0 {
+			for j := 1; j < len(gen); j++ {
+				rem[i+j] ^= gfMul(gen[j], coef)
+			}
+		}
+	}
+	return rem[len(msg):]
+}
+
+// rsSyndromes evaluates the codeword at the roots of the generator. They are
+// all zero for an intact codeword.
+func rsSyndromes(cw []byte, nsym int) ([]byte, bool) {
+	synd := make([]byte, nsym)
+	clean := true
+	for i := range synd {
+		synd[i] = gfPolyEval(cw, gfPow2(i))
+		clean = clean && synd[i] == 0
+	}
+	return synd, clean
+}
+
+// rsDecode corrects cw (message then parity) in place. erasures are byte
+// positions known to be wrong. It returns how many bytes it changed.
+func rsDecode(cw []byte, nsym int, erasures []int) (int, error) {
+	if len(erasures) > nsym {
+		return 0, errTooManyErrors
+	}
+	for _, pos := range erasures {
+		cw[pos] = 0
+	}
+	synd, clean := rsSyndromes(cw, nsym)
+	if clean {
+		return 0, nil
+	}
+
+	// Fold the known erasures out of the syndromes (Forney syndromes), then
+	// find the remaining errors with Berlekamp–Massey and a Chien search
+	fsynd := append([]byte(nil), synd...)
+	for _, pos := range erasures {
+		x := gfPow2(len(cw) - 1 - pos)
+		for j := 0; j < len(fsynd)-1; j++ {
+			fsynd[j] = gfMul(fsynd[j], x) ^ fsynd[j+1]
+		}
+	}
+	errLoc, err := rsErrorLocator(fsynd, nsym-len(erasures))
+	if err != nil {
+		return 0, err
+	}
+	errPos, err := rsFindErrors(errLoc, len(cw))
+	if err != nil {
+		return 0, err
+	}
+	if 2*len(errPos)+len(erasures) > nsym {
+		return 0, errTooManyErrors
+	}
+
+	positions := append(append([]int(nil), erasures...), errPos...)
+	rsCorrectErrata(cw, synd, positions)
+	if _, clean := rsSyndromes(cw, nsym); !clean {
+		return 0, errTooManyErrors
+	}
+	return len(positions), nil
+}
+
+// rsErrorLocator runs Berlekamp–Massey over the first steps syndromes.
+// The locator comes back lowest degree first, ready for rsFindErrors.
+func rsErrorLocator(synd []byte, steps int) ([]byte, error) {
+	errLoc, oldLoc := []byte{1}, []byte{1}
+	for i := 0; i < steps; i++ {
+		delta := synd[i]
+		for j := 1; j < len(errLoc); j++ {
+			delta ^= gfMul(errLoc[len(errLoc)-1-j], synd[i-j])
+		}
+		oldLoc = append(oldLoc, 0)
+		if delta != 0 {
+			if len(oldLoc) > len(errLoc) {
+				newLoc := gfPolyScale(oldLoc, delta)
+				oldLoc = gfPolyScale(errLoc, gfDiv(1, delta))
+				errLoc = newLoc
+			}
+			errLoc = gfPolyAdd(errLoc, gfPolyScale(oldLoc, delta))
+		}
+	}
+	for len(errLoc) > 0 && errLoc[0] == 0 {
+		errLoc = errLoc[1:]
+	}
+	if 2*(len(errLoc)-1) > steps {
+		return nil, errTooManyErrors
+	}
+
+	reversed := make([]byte, len(errLoc))
+	for i, c := range errLoc {
+		reversed[len(errLoc)-1-i] = c
+	}
+	return reversed, nil
+}
+
+// rsFindErrors is the Chien search: the roots of the locator give the error
+// positions.
+func rsFindErrors(errLoc []byte, n int) ([]int, error) {
+	var positions []int
+	for i := 0; i < n; i++ {
+		if gfPolyEval(errLoc, gfPow2(i)) == 0 {
+			positions = append(positions, n-1-i)
+		}
+	}
+	if len(positions) != len(errLoc)-1 {
+		return nil, errTooManyErrors
+	}
+	return positions, nil
+}
+
+// rsCorrectErrata fixes the bytes at positions with Forney's algorithm.
+func rsCorrectErrata(cw, synd []byte, positions []int) {
+	// Errata locator from the known positions
+	coefPos := make([]int, len(positions))
+	loc := []byte{1}
+	for i, pos := range positions {
+		coefPos[i] = len(cw) - 1 - pos
+		loc = gfPolyMul(loc, []byte{gfPow2(coefPos[i]), 1})
+	}
+
+	// Evaluator: synd(x) * loc(x) mod x^(len(loc)), syndromes reversed with a
+	// zero for the constant term
+	rsynd := make([]byte, len(synd)+1)
+	for i, s := range synd {
+		rsynd[len(synd)-1-i] = s
+	}
+	product := gfPolyMul(rsynd, loc)
+	eval := product[len(product)-len(loc):]
+
+	x := make([]byte, len(coefPos))
+	for i, p := range coefPos {
+		x[i] = gfPow2(p)
+	}
+	for i, xi := range x {
+		xiInv := gfDiv(1, xi)
+		denom := byte(1)
+		for j, xj := range x {
+			if j != i {
+				denom = gfMul(denom, 1^gfMul(xiInv, xj))
+			}
+		}
+		y := gfPolyEval(eval, xiInv)
+		cw[positions[i]] ^= gfDiv(gfMul(xi, y), denom)
+	}
+}
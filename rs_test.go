@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestGFArithmetic(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if got := gfDiv(gfMul(byte(a), byte(b)), byte(b)); got != byte(a) {
+				t.Fatalf("%d*%d/%d = %d", a, b, b, got)
+			}
+		}
+	}
+	// x^8 = x^4 + x^3 + x^2 + 1 under 0x11d
+	if got := gfMul(0x80, 2); got != 0x1d {
+		t.Errorf("0x80*2 = %#x, want 0x1d", got)
+	}
+}
+
+func TestRSDecode(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const nsym = 16
+	msg := make([]byte, 200)
+	rng.Read(msg)
+	cw := append(append([]byte(nil), msg...), rsEncode(msg, nsym)...)
+	if _, clean := rsSyndromes(cw, nsym); !clean {
+		t.Fatal("fresh codeword has non-zero syndromes")
+	}
+
+	tests := []struct {
+		name             string
+		errors, erasures int
+	}{
+		{"errors", nsym / 2, 0},
+		{"erasures", 0, nsym},
+		{"mixed", 5, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := append([]byte(nil), cw...)
+			positions := rng.Perm(len(cw))[:tt.errors+tt.erasures]
+			for _, pos := range positions {
+				damaged[pos] ^= byte(1 + rng.Intn(255))
+			}
+			fixed, err := rsDecode(damaged, nsym, positions[tt.errors:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(damaged, cw) {
+				t.Error("codeword not restored")
+			}
+			if fixed < tt.errors {
+				t.Errorf("reported %d bytes changed, want at least %d", fixed, tt.errors)
+			}
+		})
+	}
+
+	damaged := append([]byte(nil), cw...)
+	for _, pos := range rng.Perm(len(cw))[:nsym+1] {
+		damaged[pos] ^= 0xff
+	}
+	if _, err := rsDecode(damaged, nsym, rng.Perm(len(cw))[:nsym+1]); err == nil {
+		t.Error("more erasures than parity accepted")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+)
+
+// scrypt (RFC 7914) with PBKDF2-HMAC-SHA256 and Salsa20/8, written out here
+// like the AES core so the password KDF has no outside dependencies. The cost
+// is dominated by ROMix, which needs 128*r*N bytes of memory.
+
+// ScryptParams are the tunable costs. Password slots record only LogN, as an
+// index into PasswordCosts; R and P are always those of DefaultScryptParams.
+type ScryptParams struct {
+	LogN uint8 // N = 2^LogN
+	R    uint8
+	P    uint8
+}
+
+// DefaultScryptParams cost about 32 MiB and a fraction of a second.
+var DefaultScryptParams = ScryptParams{LogN: 15, R: 8, P: 1}
+
+// PasswordCosts are the LogN hide can use with DefaultScryptParams, from 32
+// MiB to 256 MiB. A slot stores its cost in passwordCostMask of the last
+// salt byte, which stays as random-looking as the rest of the salt.
+var PasswordCosts = []uint8{15, 16, 17, 18}
+
+const passwordCostMask = 3
+
+// PasswordParams is DefaultScryptParams at one of PasswordCosts.
+func PasswordParams(logN uint8) (ScryptParams, error) {
+	if !slices.Contains(PasswordCosts, logN) {
+		return ScryptParams{}, fmt.Errorf("scrypt cost must be one of %v", PasswordCosts)
+	}
+	params := DefaultScryptParams
+	params.LogN = logN
+	return params, nil
+}
+
+// setPasswordCost records params in salt, which must come from PasswordParams.
+func setPasswordCost(salt []byte, params ScryptParams) error {
+	i := slices.Index(PasswordCosts, params.LogN)
+	if i < 0 || params.R != DefaultScryptParams.R || params.P != DefaultScryptParams.P {
+		return fmt.Errorf("scrypt cost must be one of %v", PasswordCosts)
+	}
+	salt[len(salt)-1] = salt[len(salt)-1]&^passwordCostMask | byte(i)
+	return nil
+}
+
+// passwordCost is the scrypt cost recorded in salt.
+func passwordCost(salt []byte) ScryptParams {
+	params := DefaultScryptParams
+	params.LogN = PasswordCosts[salt[len(salt)-1]&passwordCostMask]
+	return params
+}
+
+// maxScryptMemory bounds what a header can make reveal allocate.
+const maxScryptMemory = 2 << 30
+
+// Validate rejects parameters outside what we are willing to run.
+func (sp ScryptParams) Validate() error {
+	if sp.LogN < 10 || sp.LogN > 22 {
+		return errors.New("scrypt cost must be between 10 and 22")
+	}
+	if sp.R < 1 || sp.R > 16 || sp.P < 1 || sp.P > 4 {
+		return errors.New("scrypt r or p out of range")
+	}
+	if 128*int(sp.R)<<sp.LogN > maxScryptMemory {
+		return errors.New("scrypt parameters need too much memory")
+	}
+	return nil
+}
+
+// pbkdf2SHA256 is PBKDF2 from RFC 8018 with HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	out := make([]byte, 0, keyLen)
+
+	for block := uint32(1); len(out) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var counter [4]byte
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
+// salsa208 applies the Salsa20/8 core to a 16-word block in place.
+func salsa208(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		// Column round
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+		// Row round
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
+
+// blockMix is scryptBlockMix over 2r 64-byte blocks held as words. tmp must
+// be the same size as b.
+func blockMix(b, tmp []uint32, r int) {
+	var x [16]uint32
+	copy(x[:], b[(2*r-1)*16:])
+
+	for i := 0; i < 2*r; i++ {
+		for j := range x {
+			x[j] ^= b[i*16+j]
+		}
+		salsa208(&x)
+		// Even blocks go to the first half, odd blocks to the second
+		dst := (i/2 + (i%2)*r) * 16
+		copy(tmp[dst:dst+16], x[:])
+	}
+	copy(b, tmp)
+}
+
+// roMix is scryptROMix, the memory-hard part.
+func roMix(block []byte, r, n int) {
+	words := 32 * r
+	x := make([]uint32, words)
+	tmp := make([]uint32, words)
+	v := make([]uint32, words*n)
+
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(block[i*4:])
+	}
+
+	for i := 0; i < n; i++ {
+		copy(v[i*words:], x)
+		blockMix(x, tmp, r)
+	}
+	for i := 0; i < n; i++ {
+		// Integerify: first word of the last 64-byte block
+		j := int(x[(2*r-1)*16] & uint32(n-1))
+		for k := range x {
+			x[k] ^= v[j*words+k]
+		}
+		blockMix(x, tmp, r)
+	}
+
+	for i, w := range x {
+		binary.LittleEndian.PutUint32(block[i*4:], w)
+	}
+}
+
+// Scrypt derives keyLen bytes from password and salt.
+func Scrypt(password, salt []byte, params ScryptParams, keyLen int) ([]byte, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	return scryptKey(password, salt, 1<<params.LogN, int(params.R), int(params.P), keyLen), nil
+}
+
+// scryptKey is scrypt without the range checks, for any power of two n.
+func scryptKey(password, salt []byte, n, r, p, keyLen int) []byte {
+	b := pbkdf2SHA256(password, salt, 1, p*128*r)
+	for i := 0; i < p; i++ {
+		roMix(b[i*128*r:(i+1)*128*r], r, n)
+	}
+	return pbkdf2SHA256(password, b, 1, keyLen)
+}
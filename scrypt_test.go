@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// RFC 7914 section 11.
+func TestPBKDF2KnownAnswers(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+			"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+			"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, tt := range tests {
+		want := unhex(t, tt.want)
+		if got := pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, len(want)); !bytes.Equal(got, want) {
+			t.Errorf("PBKDF2(%q, %q, %d) = %x, want %x", tt.password, tt.salt, tt.iterations, got, want)
+		}
+	}
+}
+
+// RFC 7914 section 12. The last vector needs 1 GiB and is skipped with
+// -short.
+func TestScryptKnownAnswers(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		n, r, p        int
+		want           string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442" +
+			"fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162" +
+			"2eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{"pleaseletmein", "SodiumChloride", 16384, 8, 1, "7023bdcb3afd7348461c06cd81fd38ebfda8fbba904f8e3ea9b543f6545da1f2" +
+			"d5432955613f0fcf62d49705242a9af9e61e85dc0d651e40dfcf017b45575887"},
+		{"pleaseletmein", "SodiumChloride", 1048576, 8, 1, "2101cb9b6a511aaeaddbbe09cf70f881ec568d574a2ffd4dabe5ee9820adaa47" +
+			"8e56fd8f4ba5d09ffa1c6d927c40f4c337304049e8a952fbcbf45c6fa77a41a4"},
+	}
+	for _, tt := range tests {
+		if tt.n > 1<<16 && testing.Short() {
+			continue
+		}
+		want := unhex(t, tt.want)
+		if got := scryptKey([]byte(tt.password), []byte(tt.salt), tt.n, tt.r, tt.p, len(want)); !bytes.Equal(got, want) {
+			t.Errorf("scrypt(%q, %q, N=%d) = %x, want %x", tt.password, tt.salt, tt.n, got, want)
+		}
+	}
+}
+
+func TestScryptValidate(t *testing.T) {
+	params := DefaultScryptParams
+	params.LogN = 4
+	if _, err := Scrypt([]byte("pw"), []byte("salt"), params, 32); err == nil {
+		t.Error("Scrypt ran with N=16, below the minimum")
+	}
+	for _, logN := range PasswordCosts {
+		if _, err := PasswordParams(logN); err != nil {
+			t.Errorf("PasswordParams(%d): %v", logN, err)
+		}
+	}
+	if _, err := PasswordParams(19); err == nil {
+		t.Error("PasswordParams accepted a cost a slot can't record")
+	}
+}
+
+func TestPasswordCostInSalt(t *testing.T) {
+	for _, logN := range PasswordCosts {
+		params, _ := PasswordParams(logN)
+		for _, last := range []byte{0x00, 0xff, 0x5a} {
+			salt := []byte{0xaa, last}
+			if err := setPasswordCost(salt, params); err != nil {
+				t.Fatal(err)
+			}
+			if got := passwordCost(salt); got != params {
+				t.Errorf("cost %d read back as %+v", logN, got)
+			}
+			if salt[0] != 0xaa || salt[1]&^passwordCostMask != last&^passwordCostMask {
+				t.Errorf("cost %d changed more of the salt than its bits: %x", logN, salt)
+			}
+		}
+	}
+	params := DefaultScryptParams
+	params.P = 2
+	if err := setPasswordCost(make([]byte, 4), params); err == nil {
+		t.Error("recorded parameters with p=2")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A body too big for one image is split into shards, one per image. The
+// encrypted body is cut into needed equal parts (the last one zero padded),
+// and count-needed spare shards of Reed–Solomon parity are added across
+// them: byte j of every shard forms one codeword. Any needed shards then
+// rebuild the body. Every shard's header carries the set ID, its index,
+// count and needed, and each shard is signed on its own.
+
+// MaxShards is the longest Reed–Solomon codeword.
+const MaxShards = 255
+
+// newShardSetID picks the ID that ties the shards of one hide together.
+func newShardSetID() (uint32, error) {
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(id[:]), nil
+}
+
+// shardSize is the size of every shard of a bodySize body.
+func shardSize(bodySize, needed int) int {
+	return (bodySize + needed - 1) / needed
+}
+
+// splitShards cuts body into count shards, any needed of which rebuild it.
+func splitShards(body []byte, count, needed int) [][]byte {
+	size := shardSize(len(body), needed)
+	shards := make([][]byte, count)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < needed {
+			copy(shards[i], body[min(i*size, len(body)):])
+		}
+	}
+	if count == needed {
+		return shards
+	}
+
+	msg := make([]byte, needed)
+	for j := 0; j < size; j++ {
+		for i := range msg {
+			msg[i] = shards[i][j]
+		}
+		for p, b := range rsEncode(msg, count-needed) {
+			shards[needed+p][j] = b
+		}
+	}
+	return shards
+}
+
+// joinShards rebuilds a bodySize body from shards, nil where one is missing.
+func joinShards(shards [][]byte, needed, bodySize int) ([]byte, error) {
+	var missing []int
+	for i, shard := range shards {
+		if shard == nil {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > len(shards)-needed {
+		return nil, errors.New("not enough shards to rebuild the body")
+	}
+
+	size := shardSize(bodySize, needed)
+	if len(missing) > 0 && missing[0] < needed {
+		for _, i := range missing {
+			shards[i] = make([]byte, size)
+		}
+		cw := make([]byte, len(shards))
+		for j := 0; j < size; j++ {
+			for i, shard := range shards {
+				cw[i] = shard[j]
+			}
+			if _, err := rsDecode(cw, len(shards)-needed, missing); err != nil {
+				return nil, fmt.Errorf("byte %d of the shards: %v", j, err)
+			}
+			for _, i := range missing {
+				shards[i][j] = cw[i]
+			}
+		}
+	}
+
+	body := make([]byte, 0, needed*size)
+	for _, shard := range shards[:needed] {
+		body = append(body, shard...)
+	}
+	return body[:bodySize], nil
+}
+
+// shardPath is where shard index of several goes: prefix-1.png and so on.
+func shardPath(prefix string, index int, ext string) string {
+	return fmt.Sprintf("%s-%d%s", prefix, index+1, ext)
+}
+
+// expandImagePaths turns a reveal -i argument into image paths: a file, every
+// file in a directory, or a glob.
+func expandImagePaths(arg string) ([]string, error) {
+	info, err := os.Stat(arg)
+	switch {
+	case err == nil && !info.IsDir():
+		return []string{arg}, nil
+	case err == nil:
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		var paths []string
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				paths = append(paths, filepath.Join(arg, entry.Name()))
+			}
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no files in %s", arg)
+		}
+		return paths, nil
+	}
+
+	paths, err := filepath.Glob(arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no such file, directory or match: %s", arg)
+	}
+	slices.Sort(paths)
+	return paths, nil
+}
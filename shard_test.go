@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestShardsRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	body := make([]byte, 1001)
+	rng.Read(body)
+
+	const count, needed = 5, 3
+	shards := splitShards(body, count, needed)
+	for i, shard := range shards {
+		if len(shard) != shardSize(len(body), needed) {
+			t.Fatalf("shard %d is %d bytes", i, len(shard))
+		}
+	}
+
+	for _, lost := range [][]int{{}, {3, 4}, {0, 2}, {1, 4}} {
+		have := make([][]byte, count)
+		for i := range shards {
+			have[i] = append([]byte(nil), shards[i]...)
+		}
+		for _, i := range lost {
+			have[i] = nil
+		}
+		got, err := joinShards(have, needed, len(body))
+		if err != nil {
+			t.Fatalf("lost %v: %v", lost, err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("lost %v: body not rebuilt", lost)
+		}
+	}
+
+	have := append([][]byte(nil), shards...)
+	have[0], have[1], have[4] = nil, nil, nil
+	if _, err := joinShards(have, needed, len(body)); err == nil {
+		t.Error("rebuilt a body from too few shards")
+	}
+}
+
+func TestExpandImagePaths(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		writeFile(t, filepath.Join(dir, shardPath("out", i, ".png")), nil)
+	}
+	writeFile(t, filepath.Join(dir, ".hidden"), nil)
+
+	want := []string{filepath.Join(dir, "out-1.png"), filepath.Join(dir, "out-2.png"), filepath.Join(dir, "out-3.png")}
+	for _, arg := range []string{dir, filepath.Join(dir, "out-*.png")} {
+		got, err := expandImagePaths(arg)
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("%s: got %v, %v", arg, got, err)
+		}
+	}
+	if got, err := expandImagePaths(want[1]); err != nil || !slices.Equal(got, want[1:2]) {
+		t.Errorf("single file: got %v, %v", got, err)
+	}
+	if _, err := expandImagePaths(filepath.Join(dir, "none-*.png")); err == nil {
+		t.Error("a glob matching nothing expanded")
+	}
+}
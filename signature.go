@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// SignatureSize is a P-256 ECDSA signature as fixed-size r || s.
+const SignatureSize = 64
+
+// signatureDigest covers the header metadata and the body ciphertext. Both are
+// the same for every recipient, so one signature serves them all.
+func signatureDigest(header, body []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("imgcrypt v1 signature"))
+	var headerLen [8]byte
+	binary.BigEndian.PutUint64(headerLen[:], uint64(len(header)))
+	h.Write(headerLen[:])
+	h.Write(header)
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// SignEmbedded signs the header metadata and body with the sender's key.
+func SignEmbedded(priv *ecdsa.PrivateKey, header, body []byte) ([]byte, error) {
+	if priv.Curve != elliptic.P256() {
+		return nil, errors.New("signing key must be P-256")
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, priv, signatureDigest(header, body))
+	if err != nil {
+		return nil, err
+	}
+
+	sig := make([]byte, SignatureSize)
+	r.FillBytes(sig[:SignatureSize/2])
+	s.FillBytes(sig[SignatureSize/2:])
+	return sig, nil
+}
+
+// VerifyEmbedded checks a signature made by SignEmbedded.
+func VerifyEmbedded(pub *ecdsa.PublicKey, header, body, sig []byte) bool {
+	if pub.Curve != elliptic.P256() || len(sig) != SignatureSize {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:SignatureSize/2])
+	s := new(big.Int).SetBytes(sig[SignatureSize/2:])
+	return ecdsa.Verify(pub, signatureDigest(header, body), r, s)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSignatureRoundTrip(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	header, body := []byte("header metadata"), []byte("body ciphertext")
+
+	sig, err := SignEmbedded(priv, header, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig) != SignatureSize {
+		t.Fatalf("signature is %d bytes", len(sig))
+	}
+	if !VerifyEmbedded(&priv.PublicKey, header, body, sig) {
+		t.Error("valid signature rejected")
+	}
+	if VerifyEmbedded(&other.PublicKey, header, body, sig) {
+		t.Error("signature verified under another key")
+	}
+
+	// The header and body can't be traded for one another
+	if VerifyEmbedded(&priv.PublicKey, []byte("header metadat"), []byte("abody ciphertext"), sig) {
+		t.Error("signature verified with bytes moved from header to body")
+	}
+	for i := range sig {
+		bad := append([]byte(nil), sig...)
+		bad[i] ^= 1
+		if VerifyEmbedded(&priv.PublicKey, header, body, bad) {
+			t.Fatalf("signature with byte %d flipped verified", i)
+		}
+	}
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if _, err := SignEmbedded(p384, header, body); err == nil {
+		t.Error("signed with a P-384 key")
+	}
+}
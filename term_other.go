@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// disableEcho turns off echo on tty with stty, for platforms where we don't
+// issue the termios ioctls ourselves.
+func disableEcho(tty *os.File) (func(), error) {
+	off := exec.Command("stty", "-echo")
+	off.Stdin = tty
+	if err := off.Run(); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		on := exec.Command("stty", "echo")
+		on.Stdin = tty
+		on.Run()
+	}, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Baseline TIFF tags we need to lay the pixels out
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffPlanarConfig    = 284
+	tiffPredictor       = 317
+	tiffTileWidth       = 322
+	tiffExtraSamples    = 338
+)
+
+// parseTIFF handles the first image of an uncompressed, chunky, 8-bit RGB
+// or RGBA TIFF stored in strips.
+func parseTIFF(data []byte) (*rawFormat, error) {
+	if len(data) < 8 {
+		return nil, errors.New("tiff: file too short")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+
+	ifd := int(order.Uint32(data[4:]))
+	if ifd < 8 || ifd+2 > len(data) {
+		return nil, errors.New("tiff: bad IFD offset")
+	}
+	count := int(order.Uint16(data[ifd:]))
+	if ifd+2+12*count > len(data) {
+		return nil, errors.New("tiff: IFD runs past the end of the file")
+	}
+
+	tags := make(map[int][]int)
+	for i := 0; i < count; i++ {
+		entry := data[ifd+2+12*i:]
+		values, err := tiffValues(data, order, entry)
+		if err != nil {
+			return nil, err
+		}
+		tags[int(order.Uint16(entry))] = values
+	}
+
+	tag := func(id, def int) int {
+		if v, ok := tags[id]; ok && len(v) > 0 {
+			return v[0]
+		}
+		return def
+	}
+
+	switch {
+	case tag(tiffCompression, 1) != 1:
+		return nil, errors.New("tiff: only uncompressed images are supported")
+	case tag(tiffPhotometric, -1) != 2:
+		return nil, errors.New("tiff: only RGB images are supported")
+	case tag(tiffPlanarConfig, 1) != 1:
+		return nil, errors.New("tiff: planar images are not supported")
+	case tag(tiffPredictor, 1) != 1:
+		return nil, errors.New("tiff: predictors are not supported")
+	case tags[tiffTileWidth] != nil:
+		return nil, errors.New("tiff: tiled images are not supported")
+	}
+	for _, bits := range tags[tiffBitsPerSample] {
+		if bits != 8 {
+			return nil, fmt.Errorf("tiff: only 8 bits per sample is supported (got %d)", bits)
+		}
+	}
+
+	samples := tag(tiffSamplesPerPixel, 1)
+	if samples < 3 {
+		return nil, errors.New("tiff: RGB needs at least three samples per pixel")
+	}
+
+	width, height := tag(tiffImageWidth, 0), tag(tiffImageLength, 0)
+	f := &rawFormat{
+		extension: ".tif",
+		raw:       data,
+		width:     width,
+		height:    height,
+		pixelSize: samples,
+		channels:  [4]int{0, 1, 2, -1},
+	}
+	// The first extra sample is alpha if it says so (1 associated,
+	// 2 unassociated); anything else is carried through untouched
+	if extra := tags[tiffExtraSamples]; samples > 3 && len(extra) > 0 && (extra[0] == 1 || extra[0] == 2) {
+		f.channels[3] = 3
+	}
+
+	offsets, counts := tags[tiffStripOffsets], tags[tiffStripByteCounts]
+	rowsPerStrip := min(tag(tiffRowsPerStrip, height), height)
+	if len(offsets) == 0 || len(offsets) != len(counts) || rowsPerStrip <= 0 {
+		return nil, errors.New("tiff: bad strip layout")
+	}
+
+	// Every row has to be somewhere in the file
+	if width <= 0 || height <= 0 || width > len(data)/samples || height > len(data)/(width*samples) {
+		return nil, errors.New("tiff: image too large or truncated")
+	}
+	rowBytes := width * samples
+	f.rowOffset = make([]int, height)
+	for y := range f.rowOffset {
+		strip := y / rowsPerStrip
+		if strip >= len(offsets) {
+			return nil, errors.New("tiff: too few strips")
+		}
+		within := (y % rowsPerStrip) * rowBytes
+		if within+rowBytes > counts[strip] {
+			return nil, errors.New("tiff: strip shorter than its rows")
+		}
+		f.rowOffset[y] = offsets[strip] + within
+	}
+	return f, nil
+}
+
+// tiffValues reads the SHORT or LONG values of one IFD entry. Other types
+// come back empty; none of the tags we use have them.
+func tiffValues(data []byte, order binary.ByteOrder, entry []byte) ([]int, error) {
+	typ := order.Uint16(entry[2:])
+	n := int(order.Uint32(entry[4:]))
+
+	var size int
+	switch typ {
+	case 3:
+		size = 2
+	case 4:
+		size = 4
+	default:
+		return nil, nil
+	}
+
+	raw := entry[8:12]
+	if n*size > 4 {
+		off := int(order.Uint32(entry[8:]))
+		if off < 0 || n < 0 || off+n*size > len(data) {
+			return nil, errors.New("tiff: tag values run past the end of the file")
+		}
+		raw = data[off : off+n*size]
+	}
+
+	values := make([]int, n)
+	for i := range values {
+		if size == 2 {
+			values[i] = int(order.Uint16(raw[2*i:]))
+		} else {
+			values[i] = int(order.Uint32(raw[4*i:]))
+		}
+	}
+	return values, nil
+}
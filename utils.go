@@ -2,18 +2,12 @@ package main
 
 import (
 	"fmt"
-	"hash/fnv"
 	"image"
 	"math/rand"
+	"strings"
 	"time"
 )
 
-func passwordToSeed(password string) int64 {
-	h := fnv.New64a()
-	h.Write([]byte(password))
-	return int64(h.Sum64())
-}
-
 func GenerateRandomPassword() string {
 	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	b := make([]byte, 16)
@@ -24,7 +18,9 @@ func GenerateRandomPassword() string {
 	return string(b)
 }
 
-func GeneratePointsInRange(width, height int, seed int64, count int, startIdx, endIdx int) ([]image.Point, error) {
+// GeneratePointsInRange picks count distinct pixels from the index window
+// [startIdx, endIdx), in an order fixed by the seed.
+func GeneratePointsInRange(width, height int, seed []byte, count int, startIdx, endIdx int) ([]image.Point, error) {
 	windowSize := endIdx - startIdx
 
 	if windowSize <= 0 {
@@ -34,14 +30,12 @@ func GeneratePointsInRange(width, height int, seed int64, count int, startIdx, e
 		return nil, fmt.Errorf("not enough pixels in window for requested count")
 	}
 
-	r := rand.New(rand.NewSource(seed))
+	perm := newKeyStream(seed).shuffledPrefix(windowSize, count)
 
-	perm := r.Perm(windowSize)
+	points := make([]image.Point, 0, count)
 
-	var points []image.Point
-
-	for i := 0; i < count && i < len(perm); i++ {
-		globalIndex := startIdx + perm[i]
+	for _, offset := range perm {
+		globalIndex := startIdx + offset
 
 		x := globalIndex % width
 		y := globalIndex / width
@@ -75,3 +69,15 @@ func BitsToBytes(bits []int) []byte {
 	}
 	return bytes
 }
+
+// stringList is a flag.Value that collects every use of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
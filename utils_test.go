@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"slices"
+	"testing"
+)
+
+// The pixel order is part of the file format: if this changes, nothing
+// hidden before can be revealed.
+func TestGeneratePointsInRangeGolden(t *testing.T) {
+	want := []image.Point{
+		{81, 8}, {95, 11}, {22, 8}, {43, 8}, {10, 7}, {67, 8},
+		{94, 6}, {32, 11}, {28, 9}, {58, 7}, {72, 7}, {60, 8},
+	}
+	got, err := GeneratePointsInRange(100, 80, []byte("imgcrypt golden seed"), 12, 625, 1250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("points = %v, want %v", got, want)
+	}
+}
+
+// Slots of different lengths are read from the same window, so a shorter
+// draw has to be a prefix of a longer one.
+func TestGeneratePointsInRangePrefix(t *testing.T) {
+	seed := []byte("prefix")
+	long, err := GeneratePointsInRange(50, 50, seed, 400, 0, 625)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := GeneratePointsInRange(50, 50, seed, 100, 0, 625)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(short, long[:100]) {
+		t.Error("a shorter draw is not a prefix of a longer one")
+	}
+
+	seen := make(map[image.Point]bool)
+	for _, pt := range long {
+		if seen[pt] {
+			t.Fatalf("point %v drawn twice", pt)
+		}
+		seen[pt] = true
+		if idx := pt.Y*50 + pt.X; idx < 0 || idx >= 625 {
+			t.Fatalf("point %v outside the window", pt)
+		}
+	}
+}
+
+func TestGeneratePointsInRangeErrors(t *testing.T) {
+	if _, err := GeneratePointsInRange(10, 10, nil, 1, 5, 5); err == nil {
+		t.Error("empty window accepted")
+	}
+	if _, err := GeneratePointsInRange(10, 10, nil, 11, 0, 10); err == nil {
+		t.Error("more points than the window has accepted")
+	}
+}
+
+func TestBitsRoundTrip(t *testing.T) {
+	data := []byte{0x00, 0xff, 0xa5, 0x01, 0x80}
+	bits := BytesToBits(data)
+	if len(bits) != 8*len(data) || bits[16] != 1 || bits[17] != 0 {
+		t.Fatalf("BytesToBits = %v", bits)
+	}
+	if got := BitsToBytes(bits); !bytes.Equal(got, data) {
+		t.Errorf("BitsToBytes = %x, want %x", got, data)
+	}
+}